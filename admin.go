@@ -0,0 +1,272 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminTimeout limits how long an admin request waits for the balancer, which cannot answer while it is blocked in dispatch.
+const adminTimeout = 5 * time.Second
+
+type admin struct {
+	b *Balancer
+}
+
+// NewAdmin returns an http.Handler with JSON endpoints for operators to inspect and control b while it is running:
+//
+//	GET    /workers             list the workers
+//	POST   /workers             add a worker, the body is like {"buffer": 8, "weight": 1, "labels": {"zone": "a"}, "capabilities": {"gpu": "true"}}
+//	DELETE /workers/{id}        remove a worker once its pending requests have completed
+//	POST   /workers/{id}/drain  stop sending requests to a worker
+//	GET    /stats               statistics of the pool
+//	GET    /snapshot            the whole state of the balancer, see Snapshot
+//	POST   /pause               stop taking requests
+//	POST   /resume              take requests again
+//	GET    /strategy            the current strategy
+//	PUT    /strategy            change the strategy, the body is like {"name": "round-robin"}
+//
+// Use http.StripPrefix to serve it under a path other than the root.
+func NewAdmin(b *Balancer) http.Handler {
+	a := &admin{b: b}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/workers", a.workers)
+	mux.HandleFunc("/workers/", a.worker)
+	mux.HandleFunc("/stats", a.stats)
+	mux.HandleFunc("/snapshot", a.snapshot)
+	mux.HandleFunc("/pause", a.pause)
+	mux.HandleFunc("/resume", a.pause)
+	mux.HandleFunc("/strategy", a.strategy)
+	return mux
+}
+
+// poolStats is the response of /stats.
+type poolStats struct {
+	Workers    int    `json:"workers"`
+	Healthy    int    `json:"healthy"`
+	Draining   int    `json:"draining"`
+	Removing   int    `json:"removing"`
+	Pending    int    `json:"pending"`
+	Dispatched int    `json:"dispatched"`
+	Completed  int    `json:"completed"`
+	Rejected   int    `json:"rejected"`
+	CrossZone  int    `json:"cross_zone"` // requests sent to Workers out of their zones
+	Paused     bool   `json:"paused"`
+	Strategy   string `json:"strategy"`
+}
+
+func reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNoWorker):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrStopped):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	reply(w, status, map[string]string{"error": err.Error()})
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	reply(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+func notAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	reply(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
+
+func (a *admin) workers(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		s, err := a.b.Snapshot(ctx)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusOK, s.Workers)
+	case http.MethodPost:
+		var body struct {
+			Buffer int               `json:"buffer"`
+			Weight int               `json:"weight"`
+			Labels Labels            `json:"labels"`
+			Caps   map[string]string `json:"capabilities"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			badRequest(w, err)
+			return
+		}
+		if body.Buffer < 0 || body.Weight < 0 {
+			badRequest(w, errors.New("buffer and weight cannot be negative"))
+			return
+		}
+		wk := NewWorker(make(chan Request, body.Buffer))
+		wk.SetWeight(body.Weight)
+		wk.SetLabels(body.Labels)
+		wk.SetCapabilities(body.Caps)
+		id, err := a.b.AddWorker(ctx, &wk)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusCreated, map[string]int{"id": id})
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// worker serves /workers/{id} and /workers/{id}/drain.
+func (a *admin) worker(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/workers/")
+	idPart, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		badRequest(w, fmt.Errorf("worker id %q: %w", idPart, err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	switch action {
+	case "":
+		if r.Method != http.MethodDelete {
+			notAllowed(w, http.MethodDelete)
+			return
+		}
+		err = a.b.RemoveWorker(ctx, id)
+	case "drain":
+		if r.Method != http.MethodPost {
+			notAllowed(w, http.MethodPost)
+			return
+		}
+		err = a.b.DrainWorker(ctx, id)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	snap, err := a.b.Snapshot(ctx)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	s := poolStats{
+		Workers:    len(snap.Workers),
+		Pending:    snap.Pending,
+		Dispatched: snap.Dispatched,
+		Completed:  snap.Completed,
+		Rejected:   snap.Rejected,
+		Paused:     snap.Paused,
+		Strategy:   snap.Strategy,
+	}
+	for _, z := range snap.Zones {
+		s.CrossZone += z.SpilledOut
+	}
+	for _, w := range snap.Workers {
+		switch w.Health {
+		case Healthy:
+			s.Healthy++
+		case Draining:
+			s.Draining++
+		case Removing:
+			s.Removing++
+		}
+	}
+	reply(w, http.StatusOK, s)
+}
+
+func (a *admin) snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notAllowed(w, http.MethodGet)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	s, err := a.b.Snapshot(ctx)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	reply(w, http.StatusOK, s)
+}
+
+// pause serves both /pause and /resume.
+func (a *admin) pause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	var err error
+	if r.URL.Path == "/pause" {
+		err = a.b.Pause(ctx)
+	} else {
+		err = a.b.Resume(ctx)
+	}
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) strategy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		s, err := a.b.Snapshot(ctx)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusOK, map[string]any{"name": s.Strategy, "available": StrategyNames()})
+	case http.MethodPut:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			badRequest(w, err)
+			return
+		}
+		s, err := NewStrategy(body.Name)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		if err := a.b.SetStrategy(ctx, s); err != nil {
+			fail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
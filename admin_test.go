@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running starts a quiet balancer with n workers and returns it with its request channel.
+func running(t *testing.T, n int) (*Balancer, chan Request) {
+	t.Helper()
+	b := &Balancer{Out: io.Discard}
+	wp := make(Pool, n)
+	comp := make(chan *Worker, n)
+	for i := range wp {
+		w := NewWorker(make(chan Request, 4))
+		wp[i] = &w
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	t.Cleanup(func() { close(r) })
+	return b, r
+}
+
+func call(t *testing.T, h http.Handler, method, path, body string, want int, v any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if rec.Code != want {
+		t.Fatalf("%s %s: status = %d, want %d: %s", method, path, rec.Code, want, rec.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	b, r := running(t, 2)
+	h := NewAdmin(b)
+
+	var workers []WorkerInfo
+	call(t, h, "GET", "/workers", "", http.StatusOK, &workers)
+	if len(workers) != 2 || workers[0].ID != 1 || workers[1].ID != 2 {
+		t.Fatalf("workers = %+v, want IDs 1 and 2", workers)
+	}
+
+	var added struct{ ID int }
+	call(t, h, "POST", "/workers", `{"buffer": 2, "weight": 3}`, http.StatusCreated, &added)
+	if added.ID != 3 {
+		t.Errorf("added ID = %d, want 3", added.ID)
+	}
+
+	call(t, h, "POST", "/workers/1/drain", "", http.StatusNoContent, nil)
+	call(t, h, "DELETE", "/workers/2", "", http.StatusNoContent, nil)
+	call(t, h, "DELETE", "/workers/9", "", http.StatusNotFound, nil)
+	call(t, h, "PUT", "/strategy", `{"name": "round-robin"}`, http.StatusNoContent, nil)
+	call(t, h, "PUT", "/strategy", `{"name": "nope"}`, http.StatusBadRequest, nil)
+
+	// only the added worker is left to take requests
+	res := make(chan int, 1)
+	r <- Request{Fn: func() int { return 7 }, Result: res}
+	if got := <-res; got != 7 {
+		t.Errorf("result = %d, want 7", got)
+	}
+
+	call(t, h, "GET", "/workers", "", http.StatusOK, &workers)
+	if len(workers) != 2 || workers[0].Health != Draining || workers[1].ID != 3 || workers[1].Weight != 3 {
+		t.Errorf("workers = %+v, want 1 draining and 3 with weight 3", workers)
+	}
+
+	call(t, h, "POST", "/pause", "", http.StatusNoContent, nil)
+	var s poolStats
+	call(t, h, "GET", "/stats", "", http.StatusOK, &s)
+	if !s.Paused || s.Workers != 2 || s.Healthy != 1 || s.Draining != 1 || s.Dispatched != 1 || s.Strategy != "round-robin" {
+		t.Errorf("stats = %+v", s)
+	}
+	select {
+	case r <- Request{Fn: func() int { return 0 }, Result: res}:
+		t.Error("a paused balancer took a request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	call(t, h, "POST", "/resume", "", http.StatusNoContent, nil)
+	call(t, h, "GET", "/pause", "", http.StatusMethodNotAllowed, nil)
+}
@@ -0,0 +1,128 @@
+// Package chanbuf provides channel adapters with buffers managed by a goroutine, grown from the buffer
+// of cmd/advconc: Unbounded never blocks a sender and Bounded holds up to a size of its own choosing.
+//
+// A buffer is used like a channel: send to In, receive from Out and close In when done. Out is closed once
+// the items sent before have been received, or at once when the context of the buffer is done, which drops
+// the items still buffered.
+package chanbuf
+
+import (
+	"context"
+	"sync/atomic"
+
+	"funmech.com/loadbalancer/queue"
+)
+
+// Watermark watches the length of a buffer: Func is called with the length when it rises to High, and then
+// not again until the length has fallen to Low. Func is called from the goroutine of the buffer, which
+// waits for it, so it should return quickly.
+type Watermark struct {
+	High, Low int
+	Func      func(n int)
+}
+
+// Unbounded is a channel without limit on its capacity: a send to In only waits for the buffer goroutine,
+// never for a receiver. It is up to the senders not to outrun the receivers forever.
+type Unbounded[T any] struct {
+	*buffer[T]
+}
+
+// NewUnbounded returns an Unbounded buffer, which runs until In is closed or ctx is done.
+func NewUnbounded[T any](ctx context.Context, marks ...Watermark) *Unbounded[T] {
+	u := &Unbounded[T]{newBuffer[T](0, marks)}
+	go u.run(ctx)
+	return u
+}
+
+// Bounded is a channel with a capacity of size: a send to In waits while size items are buffered.
+type Bounded[T any] struct {
+	*buffer[T]
+}
+
+// NewBounded returns a Bounded buffer of size, which runs until In is closed or ctx is done.
+// A size below 1 is taken as 1.
+func NewBounded[T any](ctx context.Context, size int, marks ...Watermark) *Bounded[T] {
+	if size < 1 {
+		size = 1
+	}
+	b := &Bounded[T]{newBuffer[T](size, marks)}
+	go b.run(ctx)
+	return b
+}
+
+type buffer[T any] struct {
+	in    chan T
+	out   chan T
+	size  int // 0 for no limit
+	n     atomic.Int64
+	marks []mark
+}
+
+type mark struct {
+	Watermark
+	high bool // the length has reached High and not fallen to Low since
+}
+
+func newBuffer[T any](size int, marks []Watermark) *buffer[T] {
+	b := &buffer[T]{in: make(chan T), out: make(chan T), size: size}
+	for _, m := range marks {
+		b.marks = append(b.marks, mark{Watermark: m})
+	}
+	return b
+}
+
+// In returns the channel to send to, close it when nothing more will be sent.
+func (b *buffer[T]) In() chan<- T { return b.in }
+
+// Out returns the channel to receive from, it is closed when the buffer has stopped.
+func (b *buffer[T]) Out() <-chan T { return b.out }
+
+// Len returns the count of items in the buffer, sent to In but not received from Out yet.
+func (b *buffer[T]) Len() int { return int(b.n.Load()) }
+
+func (b *buffer[T]) run(ctx context.Context) {
+	defer close(b.out)
+	in := b.in
+	buf := queue.New[T](b.size) // a Bounded one never grows, an Unbounded one shrinks after a burst
+	for in != nil || buf.Len() > 0 {
+		// Only take more when there is room, so senders wait like on a full channel.
+		recv := in
+		if b.size > 0 && buf.Len() >= b.size {
+			recv = nil
+		}
+		// Only send when there is something to send.
+		var send chan T
+		var next T
+		if buf.Len() > 0 {
+			send, next = b.out, buf.Peek()
+		}
+		select {
+		case v, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			buf.Push(v)
+		case send <- next:
+			buf.Pop()
+		case <-ctx.Done():
+			b.n.Store(0)
+			return
+		}
+		b.n.Store(int64(buf.Len()))
+		b.watch(buf.Len())
+	}
+}
+
+func (b *buffer[T]) watch(n int) {
+	for i := range b.marks {
+		m := &b.marks[i]
+		switch {
+		case !m.high && n >= m.High:
+			m.high = true
+			m.Func(n)
+		case m.high && n <= m.Low:
+			m.high = false
+		}
+	}
+}
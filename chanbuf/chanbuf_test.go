@@ -0,0 +1,112 @@
+package chanbuf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func ExampleNewUnbounded() {
+	u := NewUnbounded[string](context.Background())
+	for _, s := range []string{"a", "b", "c"} {
+		u.In() <- s // never waits for a receiver
+	}
+	close(u.In())
+	for s := range u.Out() {
+		fmt.Print(s)
+	}
+	// Output: abc
+}
+
+func TestUnboundedOrder(t *testing.T) {
+	u := NewUnbounded[int](context.Background())
+	const n = 10000
+	for i := 0; i < n; i++ {
+		u.In() <- i
+	}
+	close(u.In())
+	want := 0
+	for v := range u.Out() {
+		if v != want {
+			t.Fatalf("received %d, want %d", v, want)
+		}
+		want++
+	}
+	if want != n {
+		t.Errorf("received %d items, want %d", want, n)
+	}
+}
+
+func TestBoundedBlocks(t *testing.T) {
+	b := NewBounded[int](context.Background(), 3)
+	for i := 0; i < 3; i++ {
+		b.In() <- i
+	}
+	select {
+	case b.In() <- 3:
+		t.Fatal("a send to a full buffer went through")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if n := b.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3", n)
+	}
+	if v := <-b.Out(); v != 0 {
+		t.Errorf("received %d, want 0", v)
+	}
+	select {
+	case b.In() <- 3:
+	case <-time.After(time.Second):
+		t.Fatal("a send to a buffer with room waits")
+	}
+	close(b.In())
+	var got []int
+	for v := range b.Out() {
+		got = append(got, v)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("received %v, want [1 2 3]", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	u := NewUnbounded[int](ctx)
+	u.In() <- 1
+	cancel()
+	for range u.Out() {
+		// the buffered item may or may not come before the buffer stops
+	}
+	if n := u.Len(); n != 0 {
+		t.Errorf("Len = %d after cancel, want 0", n)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	var calls []int
+	u := NewUnbounded[int](context.Background(), Watermark{High: 3, Low: 1, Func: func(n int) { calls = append(calls, n) }})
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			u.In() <- i
+		}
+	}
+	recv := func(n int) {
+		for i := 0; i < n; i++ {
+			<-u.Out()
+		}
+	}
+	send(4) // reaches 3 once
+	recv(2) // falls to 2, not low enough
+	send(1) // back to 3, no call
+	recv(2) // falls to 1
+	send(2) // reaches 3 again
+	close(u.In())
+	recv(3)
+	if _, ok := <-u.Out(); ok {
+		t.Error("Out is not closed")
+	}
+	// calls is written by the buffer goroutine before Out is closed
+	if fmt.Sprint(calls) != "[3 3]" {
+		t.Errorf("calls = %v, want [3 3]", calls)
+	}
+}
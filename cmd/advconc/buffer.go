@@ -7,6 +7,8 @@ package main
 
 import (
 	"fmt"
+
+	"funmech.com/loadbalancer/queue"
 )
 
 // main runs synchronously:
@@ -33,27 +35,28 @@ func main() {
 // Both receiving and sending channels it manages use close to signal completion.
 // Because it has unbounded buffer, it could be dangerous if buf grows quicker than shrinks as with any unbound data structures.
 // It can be blocked when both in and out channels are blocked.
+// Package chanbuf has it as the generic Unbounded, which can be imported.
 func buffer(in <-chan int, out chan<- int) {
-	var buf []int
+	var buf queue.Ring[int] // reuses its array, where buf = buf[1:] and append kept reallocating
 	// if in channel is not disabled (it will be disabled internally when it is closed outside), or there are data to be processed, run the loop.
-	for in != nil || len(buf) > 0 {
+	for in != nil || buf.Len() > 0 {
 		var i int
 		var c chan<- int
 		// if there are data in the queue, connect a local channel to the receiver's of this buffer.
-		if len(buf) > 0 {
-			i = buf[0]
+		if buf.Len() > 0 {
+			i = buf.Peek()
 			c = out // enable send case
 		}
 		// read from in channel or send to out channel when anyone is ready
 		select {
 		case n, ok := <-in:
 			if ok {
-				buf = append(buf, n)
+				buf.Push(n)
 			} else {
 				in = nil // disable receive case
 			}
 		case c <- i: // send to receiver, and pop one out of top
-			buf = buf[1:]
+			buf.Pop()
 		}
 	}
 	close(out)
@@ -9,6 +9,8 @@ package main
 import (
 	"log"
 	"time"
+
+	"funmech.com/loadbalancer/queue"
 )
 
 // size limit of the software buffered chanel
@@ -24,6 +26,8 @@ const (
 // with size = 200, loops = 30000, it is 9 123ms/op vs  9 122ms/op
 // with size = 1000, loops = 30000, it is 9 122ms/op vs 9 124ms/op
 // with size = 2000, loops = 30000, it is 9 123ms/op vs 9 124ms/op
+// Those runs mostly measured log.Println, and boundedBuffer used to spin. BenchmarkMain runs them without the log and
+// BenchmarkTransport the transports alone with their CPU time and allocations, see buffers_test.go.
 func main() {
 	log.Println("Buffered channel")
 	t := time.Now()
@@ -85,44 +89,41 @@ func softwareChannel(cl int) {
 // A bounded(Buffer) channel does not block until it is full. built-in functions len and cap can be used to them.
 // So far I have not found any significant differences in terms performance. But if there is a size restriction, buffered channel
 // is easier - no custom code.
+//
+// It used to poll in and out with two selects with empty defaults, which kept a CPU core busy even when there was
+// nothing to do. Now a single select waits for either side: the receive case is only enabled while there is room
+// in buf and the send case only while buf has something to send.
+// buf is a ring of size items: a slice taken with buf[1:] and appended to used to reallocate every few items.
 func boundedBuffer(in <-chan int, out chan<- int, size int) {
-	var buf []int
+	if size < 1 {
+		size = 1 // it could never take anything
+	}
+	buf := queue.New[int](size)
 
-	for in != nil || len(buf) > 0 {
-		var i int
-		// freshly define a channel variable but not initialised, so by default it blocks.
+	for in != nil || buf.Len() > 0 {
+		// freshly define channel variables but not initialised, so by default they block.
+		var recv <-chan int
 		var c chan<- int
+		var i int
+		// lower than the buffer size, allow to read and append
+		if buf.Len() < size {
+			recv = in
+		}
 		// reestablish communication only when there are things to communicate
-		if len(buf) > 0 {
-			i = buf[0]
+		if buf.Len() > 0 {
+			i = buf.Peek()
 			c = out // enable send case
 		}
-		// use empty default when there is one case in a select statement
-		if len(buf) <= size { // lower than the buffer size, try to read and append
-			select {
-			case n, ok := <-in:
-				if ok {
-					// log.Println("Pushing into buffer")
-					buf = append(buf, n)
-				} else {
-					// log.Println("Receiving channels has been closed, prepare for exiting buffer goroutine")
-					in = nil // disable receive case
-				}
-			default:
-			}
-		}
-		// else {
-		// 	// log.Printf("Pause for increasing buffer, size = %d, currently len = %d\n", size, len(buf))
-		// }
-		// as long as buf is not empty, read
 		select {
+		case n, ok := <-recv:
+			if ok {
+				buf.Push(n)
+			} else {
+				in = nil // disable receive case
+			}
 		case c <- i:
-			// log.Println("Popping out from buffer")
-			buf = buf[1:]
-		default:
+			buf.Pop()
 		}
-
 	}
 	close(out)
-	log.Println(" buffer func")
 }
@@ -1,75 +1,278 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
 	"testing"
+	"time"
+
+	lb "funmech.com/loadbalancer"
+	"funmech.com/loadbalancer/chanbuf"
+	"funmech.com/loadbalancer/mpmc"
 )
 
-func BenchmarkBufferedChannel1(b *testing.B) {
-	size := 1
-	for i := 0; i < b.N; i++ {
-		bufferedChannel(size)
-	}
+// The benchmarks are table driven: each sub-benchmark is named after its parameters as key=value, like
+// BenchmarkTransport/impl=bounded/size=200/producers=8/consumers=1, so benchstat can compare two runs
+// and group them by any parameter:
+//
+//	go test -run XXX -bench . -count 10 > old.txt
+//	go test -run XXX -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+//	benchstat -col /impl new.txt
+//
+// Use -bench 'Transport/impl=mpmc' or -bench 'Transport/.*/producers=8' to run some of them.
+
+// TestMain discards the log, bufferedChannel and softwareChannel log every item, which the benchmarks would
+// measure otherwise and which would break the lines benchstat reads.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
 }
 
-func BenchmarkSoftwareChannel1(b *testing.B) {
-	size := 1
-	for i := 0; i < b.N; i++ {
-		softwareChannel(size)
-	}
+var (
+	sizes     = []int{1, 2, 200, 1000, 2000}
+	producers = []int{1, 8}
+	consumers = []int{1, 8}
+)
+
+// A transport carries ints from producers to consumers. start returns its ends: push waits while it is full,
+// pop returns false once it is closed and empty, and close is called when all producers are done.
+type transport struct {
+	name  string
+	start func(size int) (push func(int), pop func() bool, close func())
 }
 
-func BenchmarkBufferedChannel2(b *testing.B) {
-	size := 2
-	for i := 0; i < b.N; i++ {
-		bufferedChannel(size)
-	}
+// fromChans makes the ends of a transport out of the channels to send to and receive from.
+func fromChans(in chan<- int, out <-chan int) (func(int), func() bool, func()) {
+	return func(v int) { in <- v },
+		func() bool { _, ok := <-out; return ok },
+		func() { close(in) }
+}
+
+var transports = []transport{
+	{"native", func(size int) (func(int), func() bool, func()) {
+		ch := make(chan int, size)
+		return fromChans(ch, ch)
+	}},
+	{"bounded", func(size int) (func(int), func() bool, func()) {
+		in, out := make(chan int), make(chan int)
+		go boundedBuffer(in, out, size)
+		return fromChans(in, out)
+	}},
+	{"slice", func(size int) (func(int), func() bool, func()) {
+		in, out := make(chan int), make(chan int)
+		go sliceBuffer(in, out, size)
+		return fromChans(in, out)
+	}},
+	{"chanbuf", func(size int) (func(int), func() bool, func()) {
+		b := chanbuf.NewBounded[int](context.Background(), size)
+		return fromChans(b.In(), b.Out())
+	}},
+	{"mpmc", func(size int) (func(int), func() bool, func()) {
+		q := mpmc.New[int](size)
+		return func(v int) { q.Push(v) }, func() bool { _, ok := q.Pop(); return ok }, q.Close
+	}},
 }
 
-func BenchmarkSoftwareChannel2(b *testing.B) {
-	size := 2
-	for i := 0; i < b.N; i++ {
-		softwareChannel(size)
+// transfer sends n items through a transport with p producers and c consumers and receives them all.
+func transfer(n, p, c int, push func(int), pop func() bool, close func()) {
+	var sent sync.WaitGroup
+	for i := 0; i < p; i++ {
+		// share n out, the first ones send one more when it does not divide
+		m := n / p
+		if i < n%p {
+			m++
+		}
+		sent.Add(1)
+		go func(m int) {
+			defer sent.Done()
+			for j := 0; j < m; j++ {
+				push(j)
+			}
+		}(m)
 	}
+	var received sync.WaitGroup
+	for i := 0; i < c; i++ {
+		received.Add(1)
+		go func() {
+			defer received.Done()
+			for pop() {
+			}
+		}()
+	}
+	sent.Wait()
+	close()
+	received.Wait()
+}
+
+// measure runs f, which does b.N operations, and reports allocations and the CPU time per operation
+// besides the wall time: a transport which spins uses more CPU time than wall time.
+func measure(b *testing.B, f func()) {
+	b.ReportAllocs()
+	cpu := cpuTime()
+	b.ResetTimer()
+	f()
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-cpu)/float64(b.N), "cpu-ns/op")
 }
 
-func BenchmarkBufferedChannel200(b *testing.B) {
-	size := 200
-	for i := 0; i < b.N; i++ {
-		bufferedChannel(size)
+// BenchmarkTransport moves b.N items through every transport, an op is an item.
+func BenchmarkTransport(b *testing.B) {
+	for _, t := range transports {
+		for _, size := range sizes {
+			for _, p := range producers {
+				for _, c := range consumers {
+					t, size, p, c := t, size, p, c
+					name := fmt.Sprintf("impl=%s/size=%d/producers=%d/consumers=%d", t.name, size, p, c)
+					b.Run(name, func(b *testing.B) {
+						push, pop, close := t.start(size)
+						measure(b, func() { transfer(b.N, p, c, push, pop, close) })
+					})
+				}
+			}
+		}
 	}
 }
 
-func BenchmarkSoftwareChannel200(b *testing.B) {
-	size := 200
-	for i := 0; i < b.N; i++ {
-		softwareChannel(size)
+// BenchmarkMain runs what main runs, loops items with one producer and one consumer, without the log.
+// An op is a run of loops items.
+func BenchmarkMain(b *testing.B) {
+	for _, size := range sizes {
+		size := size
+		b.Run(fmt.Sprintf("impl=buffered/size=%d", size), func(b *testing.B) {
+			measure(b, func() {
+				for i := 0; i < b.N; i++ {
+					bufferedChannel(size)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("impl=software/size=%d", size), func(b *testing.B) {
+			measure(b, func() {
+				for i := 0; i < b.N; i++ {
+					softwareChannel(size)
+				}
+			})
+		})
 	}
 }
 
-func BenchmarkBufferedChannel1000(b *testing.B) {
-	size := 1000
-	for i := 0; i < b.N; i++ {
-		bufferedChannel(size)
+// BenchmarkBalancer sends b.N requests doing nothing through a Balancer, from requesters each waiting for the
+// result of its request before sending the next one. An op is a request, from its send to its result.
+func BenchmarkBalancer(b *testing.B) {
+	for _, inbox := range []string{"chan", "queue"} {
+		for _, workers := range []int{1, 8} {
+			for _, size := range []int{1, 16} {
+				for _, p := range []int{1, 8, 64} {
+					inbox, workers, size, p := inbox, workers, size, p
+					name := fmt.Sprintf("inbox=%s/workers=%d/size=%d/requesters=%d", inbox, workers, size, p)
+					b.Run(name, func(b *testing.B) {
+						measure(b, func() { balance(b.N, inbox, workers, size, p) })
+					})
+				}
+			}
+		}
 	}
 }
 
-func BenchmarkSoftwareChannel1000(b *testing.B) {
-	size := 1000
-	for i := 0; i < b.N; i++ {
-		softwareChannel(size)
+func balance(n int, inbox string, workers, size, requesters int) {
+	wp := make(lb.Pool, workers)
+	for i := range wp {
+		var w lb.Worker
+		if inbox == "queue" {
+			w = lb.NewQueueWorker(size)
+		} else {
+			w = lb.NewWorker(make(chan lb.Request, size))
+		}
+		wp[i] = &w
 	}
+	// A worker finding comp full waits for the balancer, which may be waiting in dispatch for that worker.
+	// Requesters get their results before the balancer takes the completions, so these are not bounded by
+	// the requesters, or by what the workers hold, but every one of the n requests completes once.
+	comp := make(chan *lb.Worker, n)
+	for _, w := range wp {
+		go w.Work(comp)
+	}
+	b := &lb.Balancer{Out: io.Discard}
+	req := make(chan lb.Request)
+	stopped := make(chan struct{})
+	go func() {
+		b.Balance(wp, req, comp)
+		close(stopped)
+	}()
+
+	fn := func() int { return 1 }
+	var wg sync.WaitGroup
+	for i := 0; i < requesters; i++ {
+		m := n / requesters
+		if i < n%requesters {
+			m++
+		}
+		wg.Add(1)
+		go func(m int) {
+			defer wg.Done()
+			res := make(chan int, 1)
+			for j := 0; j < m; j++ {
+				req <- lb.Request{Fn: fn, Result: res}
+				<-res
+			}
+		}(m)
+	}
+	wg.Wait()
+	close(req)
+	<-stopped
 }
 
-func BenchmarkBufferedChannel2000(b *testing.B) {
-	size := 2000
-	for i := 0; i < b.N; i++ {
-		bufferedChannel(size)
+// sliceBuffer is boundedBuffer as it was with a slice for buf, taking buf[1:] and appending to it,
+// to compare the allocations of both.
+func sliceBuffer(in <-chan int, out chan<- int, size int) {
+	var buf []int
+	for in != nil || len(buf) > 0 {
+		var recv <-chan int
+		var c chan<- int
+		var i int
+		if len(buf) < size {
+			recv = in
+		}
+		if len(buf) > 0 {
+			i = buf[0]
+			c = out
+		}
+		select {
+		case n, ok := <-recv:
+			if ok {
+				buf = append(buf, n)
+			} else {
+				in = nil
+			}
+		case c <- i:
+			buf = buf[1:]
+		}
 	}
+	close(out)
 }
 
-func BenchmarkSoftwareChannel2000(b *testing.B) {
-	size := 2000
-	for i := 0; i < b.N; i++ {
-		softwareChannel(size)
+// TestBoundedBufferIdle checks that boundedBuffer waits rather than spins when nothing comes.
+func TestBoundedBufferIdle(t *testing.T) {
+	if cpuTime() == 0 {
+		t.Skip("CPU time is not measured on this system")
+	}
+	in, out := make(chan int), make(chan int)
+	go boundedBuffer(in, out, 10)
+	in <- 1 // something to send but nobody receives
+	cpu := cpuTime()
+	time.Sleep(200 * time.Millisecond)
+	if used := cpuTime() - cpu; used > 100*time.Millisecond {
+		t.Errorf("idle buffer used %v of CPU in 200ms", used)
+	}
+	close(in)
+	if v := <-out; v != 1 {
+		t.Errorf("received %d, want 1", v)
+	}
+	if _, ok := <-out; ok {
+		t.Error("out is not closed")
 	}
 }
@@ -4,10 +4,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
-	"strings"
 	"time"
+
+	"funmech.com/loadbalancer/quit"
 )
 
 // there is a group of subordinates which listen to a channel, once a value is set in the channel,
@@ -15,19 +17,16 @@ import (
 // stopped until they are successfully completed. Once every subordinate has reported they
 // have done, the controller exit.
 // subordinate communicates with the controller through two channels: one for hearing and one
-// for acknowledging.
-func subordinate(no int, chat chan string, signal <-chan string, ack chan<- string) {
+// for acknowledging, both in its quit.Member: Stopping is closed to tell it to stop and Ack reports it has.
+func subordinate(no int, chat chan string, m *quit.Member) {
+	defer m.Ack()
 	s := 0
 	no++
 	for {
 		s++
 		select {
-		case m := <-signal:
-			if strings.Contains(m, "ACK") {
-				panic("Stop channel has been written out of order:" + m)
-			}
-			fmt.Printf("  subordinate %d has received signal %q.\n", no, m)
-			ack <- fmt.Sprintf("    ACK: subordinate %d has received signal", no)
+		case <-m.Stopping():
+			fmt.Printf("  subordinate %d has received the signal.\n", no)
 			return
 		default:
 			time.Sleep(time.Duration(rand.Intn(9000)) * time.Microsecond)
@@ -37,28 +36,30 @@ func subordinate(no int, chat chan string, signal <-chan string, ack chan<- stri
 	}
 }
 
+// controller used to stop the subordinates one by one, each stop waiting for an ack on an unbuffered channel,
+// so stopping them took as long as all of them together. The quit.Group tells them all at once and waits
+// for their acks together, so it takes as long as the slowest one, and it does not wait for longer than
+// the deadline: the ones which have not acknowledged by then are named as stragglers.
 func controller() {
 	nSub := 500
 	chat := make(chan string, nSub)
-	stop := make(chan string) // not buffered, running in synchronous, easy to spot a deadlock
-	ack := make(chan string)  // not buffered, running in synchronous, easy to spot a deadlock
-	stopped := make(chan struct{})
+	var g quit.Group
+	stopped := make(chan error)
 
 	for i := 0; i < nSub; i++ {
-		go subordinate(i, chat, stop, ack)
+		go subordinate(i, chat, g.Join(fmt.Sprintf("subordinate %d", i+1)))
 	}
 
 	go func() {
-		// The whole chatting can only last for 5 seconds, but we are very kind to not shut anyone rashly, so, the slowest sayer will
-		// take some to quit, controller wait patiently for everyone
+		// The whole chatting can only last for 5 seconds, then everyone is commanded to quit at once and given
+		// a second to finish what it is saying.
 		<-time.After(5 * time.Second)
-		for i := 0; i < nSub; i++ {
-			// commanding for quitting
-			stop <- fmt.Sprintf("commanding %d: please quit", i+1)
-			// now we wait for acknowledgement. This is a blocking action
-			fmt.Printf("Stopped %d with its message: %s\n", i+1, <-ack)
-		}
-		stopped <- struct{}{}
+		t := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := g.Stop(ctx)
+		fmt.Println("Stopping took", time.Since(t))
+		stopped <- err
 	}()
 
 	fmt.Println("Lets hear them")
@@ -66,7 +67,11 @@ func controller() {
 		select {
 		case saying := <-chat:
 			fmt.Println(saying)
-		case <-stopped:
+		case err := <-stopped:
+			if err != nil {
+				fmt.Println("Some have not stopped in time:", err)
+				return
+			}
 			fmt.Println("All have been stopped, time to go home")
 			return
 		}
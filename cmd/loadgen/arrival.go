@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	lb "funmech.com/loadbalancer"
+)
+
+// An arrival returns the offset of the next request from the start of a run,
+// ok is false when there are no more arrivals.
+// Open-loop patterns do not wait for the completion of earlier requests, so the balancer can be overloaded.
+type arrival func() (offset time.Duration, ok bool)
+
+// A rate gives the arrival rate, in requests per second, at an offset from the start of a run.
+type rate func(offset time.Duration) float64
+
+// poisson generates arrivals of a Poisson process whose rate may vary over time.
+// The gap to the next arrival is drawn with the rate at the current offset, which is
+// close enough when the rate changes slowly compared to the gaps.
+func poisson(r *rand.Rand, rt rate, duration time.Duration) arrival {
+	var t time.Duration
+	return func() (time.Duration, bool) {
+		for t < duration {
+			lambda := rt(t)
+			if lambda <= 0 {
+				// nothing arrives at this rate, check again a bit later
+				t += 10 * time.Millisecond
+				continue
+			}
+			t += time.Duration(r.ExpFloat64() / lambda * float64(time.Second))
+			if t < duration {
+				return t, true
+			}
+		}
+		return 0, false
+	}
+}
+
+// constant is the rate of a homogeneous Poisson process.
+func constant(perSecond float64) rate {
+	return func(time.Duration) float64 { return perSecond }
+}
+
+// steps holds each rate for the length of a step and keeps the last one until the end of the run.
+func steps(rates []float64, step time.Duration) rate {
+	return func(t time.Duration) float64 {
+		i := int(t / step)
+		if i >= len(rates) {
+			i = len(rates) - 1
+		}
+		return rates[i]
+	}
+}
+
+// ramp changes the rate linearly from one value to another over the run.
+func ramp(from, to float64, duration time.Duration) rate {
+	return func(t time.Duration) float64 {
+		return from + (to-from)*float64(t)/float64(duration)
+	}
+}
+
+// A schedule yields the arrival offset and the service time of the next request.
+type schedule func() (offset, service time.Duration, ok bool)
+
+// sample draws a service time for each arrival from svc.
+func sample(next arrival, svc service, r *rand.Rand) schedule {
+	return func() (time.Duration, time.Duration, bool) {
+		offset, ok := next()
+		if !ok {
+			return 0, 0, false
+		}
+		return offset, svc(r), true
+	}
+}
+
+// replay takes both arrivals and service times from a recorded trace.
+func replay(entries []lb.TraceEntry) schedule {
+	return func() (time.Duration, time.Duration, bool) {
+		if len(entries) == 0 {
+			return 0, 0, false
+		}
+		e := entries[0]
+		entries = entries[1:]
+		return e.Offset, e.Service, true
+	}
+}
+
+// parseRates parses a comma separated list of rates like "50,100,200".
+func parseRates(s string) ([]float64, error) {
+	var rates []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate %q: %w", f, err)
+		}
+		rates = append(rates, v)
+	}
+	return rates, nil
+}
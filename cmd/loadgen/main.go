@@ -0,0 +1,449 @@
+// Command loadgen drives a load balancer with synthetic traffic and reports latency and throughput.
+//
+// Open-loop patterns (poisson, step, ramp and trace) send requests at their scheduled time, up to -inflight
+// of them pending at once, so they show how the balancer behaves when it is overloaded. The closed-loop
+// pattern runs a fixed number of clients which each wait for a result before sending the next request,
+// like the requesters in cmd/buffered. The none pattern sends nothing and only keeps the balancer running.
+//
+//	go run ./cmd/loadgen -pattern poisson -rate 200 -service exp:10ms -duration 5s
+//	go run ./cmd/loadgen -pattern closed -clients 16 -think 5ms -format json
+//	go run ./cmd/loadgen -pattern step -rates 50,100,400 -step 2s
+//	go run ./cmd/loadgen -pattern ramp -from 10 -to 500 -duration 10s
+//	go run ./cmd/loadgen -pattern trace -trace incident.jsonl
+//	go run ./cmd/loadgen -listen localhost:9090 -workers 1 -duration 30s
+//
+// With -listen, agents of cmd/worker can join the pool over TCP while it runs. Every request is a "sleep"
+// task, which local and remote workers run alike.
+//
+// With -serve, the balancer takes requests over HTTP as well, see loadbalancer.NewFrontend, and with -target
+// loadgen sends its requests to such a front end instead of running a balancer itself:
+//
+//	go run ./cmd/loadgen -pattern none -serve localhost:8080 -workers 8 -duration 30s &
+//	go run ./cmd/loadgen -target http://localhost:8080 -pattern poisson -rate 500
+//
+// A request which fails, for example one rejected by the balancer, counts as failed and not in the latencies.
+//
+// The trace pattern reads a trace of JSON lines (see loadbalancer.TraceEntry) and takes both arrival
+// offsets and service times from it; cmd/replay replays a trace in more detail.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lb "funmech.com/loadbalancer"
+	"funmech.com/loadbalancer/internal/hist"
+)
+
+type config struct {
+	pattern  string
+	workers  int
+	buffer   int
+	duration time.Duration
+	rate     float64
+	rates    string
+	step     time.Duration
+	from, to float64
+	clients  int
+	think    time.Duration
+	trace    string
+	service  string
+	format   string
+	seed     int64
+	strategy string
+	admin    string
+	otlp     string
+	listen   string
+	inbox    string
+	inflight int
+	serve    string
+	target   string
+}
+
+func main() {
+	var c config
+	flag.StringVar(&c.pattern, "pattern", "poisson", "arrival pattern: poisson, closed, step, ramp, trace or none")
+	flag.IntVar(&c.workers, "workers", 4, "number of workers in the pool")
+	flag.IntVar(&c.buffer, "buffer", 16, "size of the request channel of each worker")
+	flag.StringVar(&c.inbox, "inbox", "chan", "what holds the requests of each worker: chan or queue, a lock-free queue")
+	flag.DurationVar(&c.duration, "duration", 10*time.Second, "length of the run, not used by trace")
+	flag.Float64Var(&c.rate, "rate", 100, "poisson: requests per second")
+	flag.StringVar(&c.rates, "rates", "50,100,200", "step: comma separated requests per second of each step")
+	flag.DurationVar(&c.step, "step", 2*time.Second, "step: length of each step")
+	flag.Float64Var(&c.from, "from", 10, "ramp: requests per second at the start")
+	flag.Float64Var(&c.to, "to", 200, "ramp: requests per second at the end")
+	flag.IntVar(&c.clients, "clients", 8, "closed: number of concurrent clients")
+	flag.IntVar(&c.inflight, "inflight", 1024, "most requests of an open-loop pattern in flight at once")
+	flag.DurationVar(&c.think, "think", 0, "closed: pause of a client between a result and its next request")
+	flag.StringVar(&c.trace, "trace", "", "trace: trace file of JSON lines")
+	flag.StringVar(&c.service, "service", "exp:10ms", "service time distribution: const:D, uniform:MIN-MAX, exp:MEAN or normal:MEAN,SD")
+	flag.StringVar(&c.format, "format", "text", "report format: text or json")
+	flag.StringVar(&c.strategy, "strategy", "least-pending", "strategy of the balancer: "+strings.Join(lb.StrategyNames(), ", "))
+	flag.StringVar(&c.otlp, "otlp", "", "file to write the spans of all requests to, as OTLP/JSON lines")
+	flag.StringVar(&c.admin, "admin", "", "address to serve the admin API on during the run, like localhost:8081")
+	flag.StringVar(&c.listen, "listen", "", "address to take remote workers on during the run, like localhost:9090")
+	flag.StringVar(&c.serve, "serve", "", "address to serve the HTTP front end of the balancer on during the run, like localhost:8080")
+	flag.StringVar(&c.target, "target", "", "URL of the HTTP front end of a balancer to send the requests to instead of a local one")
+	flag.Int64Var(&c.seed, "seed", 0, "random seed, 0 picks one from the clock")
+	flag.Parse()
+
+	rep, err := run(c)
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintln(os.Stderr, uerr)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch c.format {
+	case "json":
+		err = rep.writeJSON(os.Stdout)
+	default:
+		err = rep.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// tasks has the task the requests are made of, cmd/worker knows it too.
+var tasks = lb.NewRegistry()
+
+func init() {
+	lb.Handle(tasks, "sleep", lb.JSON, func(d time.Duration) (int, error) {
+		time.Sleep(d)
+		return 1, nil
+	})
+}
+
+// sleeper returns a request which takes d to complete, on a local or a remote worker.
+func sleeper(d time.Duration, res chan int, errc chan error) lb.Request {
+	t, err := tasks.Task("sleep", d)
+	if err != nil {
+		panic(err) // a Duration always encodes
+	}
+	req := tasks.Request(t)
+	req.Result, req.Err = res, errc
+	return req
+}
+
+// A sender sends a request which takes d to complete and waits for its outcome.
+type sender func(d time.Duration) error
+
+// local sends the requests to the balancer taking them from r.
+func local(r chan<- lb.Request) sender {
+	return func(d time.Duration) error {
+		res, errc := make(chan int, 1), make(chan error, 1)
+		r <- sleeper(d, res, errc)
+		select {
+		case <-res:
+			return nil
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// remote sends the requests to the front end of a balancer at target, see loadbalancer.NewFrontend.
+func remote(client *http.Client, target string) sender {
+	url := strings.TrimSuffix(target, "/") + "/tasks/sleep"
+	return func(d time.Duration) error {
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var e struct{ Error string }
+			json.NewDecoder(resp.Body).Decode(&e)
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+}
+
+// recorder collects latencies and failures from many requesters.
+type recorder struct {
+	mu     sync.Mutex
+	hist   hist.Histogram
+	failed int64
+}
+
+func (r *recorder) record(d time.Duration, err error) {
+	r.mu.Lock()
+	if err != nil {
+		r.failed++
+	} else {
+		r.hist.Record(d)
+	}
+	r.mu.Unlock()
+}
+
+// usageError is a flag value run cannot work with.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func run(c config) (report, error) {
+	if c.workers < 1 && c.target == "" {
+		return report{}, fmt.Errorf("need at least one worker, got %d", c.workers)
+	}
+	if c.duration <= 0 && c.pattern != "trace" {
+		return report{}, usageError(fmt.Sprintf("-duration must be positive, got %v", c.duration))
+	}
+	if c.step <= 0 && c.pattern == "step" {
+		return report{}, usageError(fmt.Sprintf("-step must be positive, got %v", c.step))
+	}
+	if c.inflight < 1 {
+		return report{}, usageError(fmt.Sprintf("-inflight must be positive, got %d", c.inflight))
+	}
+	if c.clients < 1 && c.pattern == "closed" {
+		return report{}, usageError(fmt.Sprintf("-clients must be positive, got %d", c.clients))
+	}
+	if c.target != "" && (c.serve != "" || c.listen != "" || c.admin != "" || c.otlp != "") {
+		return report{}, usageError("-target sends the requests to a balancer elsewhere, -serve, -listen, -admin and -otlp apply to a local one")
+	}
+	svc, err := parseService(c.service)
+	if err != nil {
+		return report{}, err
+	}
+	if c.seed == 0 {
+		c.seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(c.seed))
+
+	var next schedule
+	switch c.pattern {
+	case "poisson":
+		next = sample(poisson(rnd, constant(c.rate), c.duration), svc, rnd)
+	case "step":
+		rates, err := parseRates(c.rates)
+		if err != nil {
+			return report{}, err
+		}
+		next = sample(poisson(rnd, steps(rates, c.step), c.duration), svc, rnd)
+	case "ramp":
+		next = sample(poisson(rnd, ramp(c.from, c.to, c.duration), c.duration), svc, rnd)
+	case "trace":
+		f, err := os.Open(c.trace)
+		if err != nil {
+			return report{}, err
+		}
+		entries, err := lb.ReadTrace(f)
+		f.Close()
+		if err != nil {
+			return report{}, fmt.Errorf("trace %s: %w", c.trace, err)
+		}
+		next = replay(entries)
+	case "closed", "none":
+	default:
+		return report{}, fmt.Errorf("unknown pattern %q", c.pattern)
+	}
+
+	var send sender
+	if c.target != "" {
+		client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: c.inflight}}
+		send = remote(client, c.target)
+	} else {
+		r, stop, err := start(c)
+		if err != nil {
+			return report{}, err
+		}
+		defer stop()
+		send = local(r)
+	}
+
+	var rec recorder
+	var sent int64
+	begin := time.Now()
+	switch c.pattern {
+	case "closed":
+		sent = closedLoop(send, &rec, svc, rnd, c)
+	case "none":
+		time.Sleep(c.duration)
+	default:
+		sent = openLoop(send, &rec, next, begin, c.inflight)
+	}
+	elapsed := time.Since(begin)
+	return newReport(c.pattern, c.workers, sent, rec.failed, elapsed, &rec.hist), nil
+}
+
+// start runs a balancer with a pool of c.workers and returns its request channel.
+// Calling stop waits for the requests in flight and stops the balancer.
+func start(c config) (r chan lb.Request, stop func(), err error) {
+	strategy, err := lb.NewStrategy(c.strategy)
+	if err != nil {
+		return nil, nil, err
+	}
+	wp := make(lb.Pool, c.workers)
+	size := c.buffer
+	switch c.inbox {
+	case "chan":
+		for i := range wp {
+			w := lb.NewWorker(make(chan lb.Request, size))
+			wp[i] = &w
+		}
+	case "queue":
+		// a queue has room for a power of two of requests
+		size = 2
+		for size < c.buffer {
+			size <<= 1
+		}
+		for i := range wp {
+			w := lb.NewQueueWorker(size)
+			wp[i] = &w
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown inbox %q", c.inbox)
+	}
+	// Workers finding comp full wait for the balancer, so a balancer blocked in dispatch on a worker which
+	// waits for it would never stop. The requests wait in a FairQueue of the balancer instead, which
+	// dispatches only to workers with room, so a worker holds at most its buffer and the request in hand.
+	// comp has room for all of them, the workers do not wait for the balancer either.
+	comp := make(chan *lb.Worker, c.workers*(size+1))
+	var workers sync.WaitGroup
+	for _, w := range wp {
+		workers.Add(1)
+		go func(w *lb.Worker) {
+			defer workers.Done()
+			w.Work(comp)
+		}(w)
+	}
+
+	var closers []func() error
+	stop = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	r = make(chan lb.Request)
+	// The run decides when to stop by closing r, so the balancer does not need to time out.
+	b := &lb.Balancer{Out: io.Discard, Timeout: 24 * time.Hour, Strategy: strategy, FairQueue: lb.NewFairQueue(nil, 0)}
+	if c.otlp != "" {
+		f, err := os.Create(c.otlp)
+		if err != nil {
+			return nil, nil, err
+		}
+		bw := bufio.NewWriter(f)
+		closers = append(closers, f.Close, bw.Flush)
+		b.Tracer = lb.NewFileTracer(bw, "loadgen")
+	}
+	go b.Balance(wp, r, comp)
+	closers = append(closers, func() error {
+		close(r)
+		workers.Wait()
+		return nil
+	})
+	if c.admin != "" {
+		go func() {
+			log.Println(http.ListenAndServe(c.admin, lb.NewAdmin(b)))
+		}()
+	}
+	if c.listen != "" {
+		l, err := net.Listen("tcp", c.listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, l.Close)
+		s := &lb.RemoteServer{Balancer: b}
+		go s.Serve(l)
+	}
+	if c.serve != "" {
+		l, err := net.Listen("tcp", c.serve)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv := &http.Server{Handler: lb.NewFrontend(tasks, r)}
+		go srv.Serve(l)
+		// the front end must have stopped sending before r is closed
+		closers = append(closers, func() error { return srv.Shutdown(context.Background()) })
+	}
+	return r, stop, nil
+}
+
+// openLoop sends a request at every arrival and waits until all of them have completed.
+// The latency of a request is measured from its scheduled arrival, so time spent waiting for
+// the balancer to accept it, or for one of the inflight requests before it to complete, is not
+// hidden (no coordinated omission).
+func openLoop(send sender, rec *recorder, next schedule, start time.Time, inflight int) int64 {
+	var wg sync.WaitGroup
+	var sent int64
+	slots := make(chan struct{}, inflight)
+	for {
+		offset, d, ok := next()
+		if !ok {
+			break
+		}
+		at := start.Add(offset)
+		time.Sleep(time.Until(at))
+		slots <- struct{}{}
+		sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := send(d)
+			rec.record(time.Since(at), err)
+			<-slots
+		}()
+	}
+	wg.Wait()
+	return sent
+}
+
+// closedLoop runs c.clients requesters for c.duration, each sends a request only after the previous one has completed.
+func closedLoop(send sender, rec *recorder, svc service, rnd *rand.Rand, c config) int64 {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sent int64
+	deadline := time.Now().Add(c.duration)
+	for i := 0; i < c.clients; i++ {
+		// each client has its own source because rand.Rand is not safe for concurrent use
+		cr := rand.New(rand.NewSource(rnd.Int63()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				err := send(svc(cr))
+				rec.record(time.Since(t), err)
+				n++
+				time.Sleep(c.think)
+			}
+			mu.Lock()
+			sent += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return sent
+}
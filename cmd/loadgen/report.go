@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"funmech.com/loadbalancer/internal/hist"
+)
+
+// report is the outcome of a run. Latencies are in milliseconds.
+type report struct {
+	Pattern    string   `json:"pattern"`
+	Workers    int      `json:"workers"`
+	Elapsed    float64  `json:"elapsed_s"`
+	Sent       int64    `json:"sent"`
+	Completed  int64    `json:"completed"`
+	Failed     int64    `json:"failed"`
+	Throughput float64  `json:"throughput_rps"`
+	Latency    latency  `json:"latency_ms"`
+	Histogram  []bucket `json:"histogram"`
+}
+
+type latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99.9"`
+	Max  float64 `json:"max"`
+}
+
+// bucket is a non-empty histogram bucket: Count values are at or below Le but above the previous bucket.
+type bucket struct {
+	Le    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func latencyOf(h *hist.Histogram) latency {
+	return latency{
+		Min:  ms(h.Min()),
+		Mean: ms(h.Mean()),
+		P50:  ms(h.Quantile(0.5)),
+		P90:  ms(h.Quantile(0.9)),
+		P99:  ms(h.Quantile(0.99)),
+		P999: ms(h.Quantile(0.999)),
+		Max:  ms(h.Max()),
+	}
+}
+
+func newReport(pattern string, workers int, sent, failed int64, elapsed time.Duration, h *hist.Histogram) report {
+	r := report{
+		Pattern:   pattern,
+		Workers:   workers,
+		Elapsed:   elapsed.Seconds(),
+		Sent:      sent,
+		Completed: h.Count(),
+		Failed:    failed,
+		Latency:   latencyOf(h),
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(h.Count()) / elapsed.Seconds()
+	}
+	for _, b := range h.Buckets() {
+		r.Histogram = append(r.Histogram, bucket{Le: ms(b.High), Count: b.Count})
+	}
+	return r
+}
+
+func (r report) writeJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+// writeText prints a summary followed by the percentile distribution of the latencies,
+// similar to the output of HdrHistogram.
+func (r report) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "pattern: %s, workers: %d\n", r.Pattern, r.Workers)
+	fmt.Fprintf(w, "sent: %d, completed: %d, failed: %d in %.2fs, throughput: %.2f req/s\n\n",
+		r.Sent, r.Completed, r.Failed, r.Elapsed, r.Throughput)
+	l := r.Latency
+	fmt.Fprintf(w, "latency (ms)  min: %.3f  mean: %.3f  p50: %.3f  p90: %.3f  p99: %.3f  p99.9: %.3f  max: %.3f\n\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	fmt.Fprintf(w, "%12s %12s %12s\n", "value(ms)", "percentile", "total count")
+	var seen int64
+	for _, b := range r.Histogram {
+		seen += b.Count
+		fmt.Fprintf(w, "%12.3f %12.6f %12d\n", b.Le, float64(seen)/float64(r.Completed), seen)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
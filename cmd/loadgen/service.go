@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A service is a distribution of service times: how long a worker spends on a request.
+type service func(r *rand.Rand) time.Duration
+
+// parseService turns a specification like "exp:10ms" into a service time distribution.
+// Supported forms are:
+//
+//	const:D          always D
+//	uniform:MIN-MAX  uniformly distributed between MIN and MAX
+//	exp:MEAN         exponentially distributed with the mean of MEAN
+//	normal:MEAN,SD   normally distributed, negative samples are cut to zero
+func parseService(spec string) (service, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("service %q: want kind:args", spec)
+	}
+	switch kind {
+	case "const":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", spec, err)
+		}
+		return func(*rand.Rand) time.Duration { return d }, nil
+	case "uniform":
+		lo, hi, err := durationPair(arg, "-")
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", spec, err)
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("service %q: max is smaller than min", spec)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return lo + time.Duration(r.Int63n(int64(hi-lo)+1))
+		}, nil
+	case "exp":
+		mean, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", spec, err)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return time.Duration(r.ExpFloat64() * float64(mean))
+		}, nil
+	case "normal":
+		mean, sd, err := durationPair(arg, ",")
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", spec, err)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return time.Duration(math.Max(0, r.NormFloat64()*float64(sd)+float64(mean)))
+		}, nil
+	}
+	return nil, fmt.Errorf("service %q: unknown kind %q", spec, kind)
+}
+
+func durationPair(s, sep string) (time.Duration, time.Duration, error) {
+	a, b, ok := strings.Cut(s, sep)
+	if !ok {
+		return 0, 0, fmt.Errorf("want two durations separated by %q", sep)
+	}
+	x, err := time.ParseDuration(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := time.ParseDuration(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	return x, y, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
 	"sync"
 	"time"
 
@@ -33,6 +35,17 @@ func requester(work chan<- lb.Request, nWorker int) {
 //
 // Balancer received request. Start to dispatch ...
 // fatal error: all goroutines are asleep - deadlock!
+//
+// The watchdog of the balancer reports the deadlock with a snapshot of the workers and channels instead:
+//
+// balancer stalled: blocked on sending to a worker for 2.000005168s, pending = 3
+//
+//	requests: len = 0, cap = 0
+//	complete: len = 0, cap = 0
+//	worker 3: pending = 1, queue len = 0, cap = 0, balancer is blocked on sending to it
+//	worker 2: pending = 1, queue len = 0, cap = 0
+//	worker 1: pending = 1, queue len = 0, cap = 0
+//	...
 func main() {
 	nRequester := 5 // this is the maximal pending total: each requester will wait until last request has completed before a new request is sent
 	nWorker := 3
@@ -54,8 +67,15 @@ func main() {
 	r := make(chan lb.Request)
 
 	// Set the Balancer up by passing on request and notification channels
-	b := lb.Balancer{}
-	// Balance has a timeout of 10s clause to exit
+	b := lb.Balancer{
+		StallTimeout: 2 * time.Second,
+		OnStall: func(s lb.Stall) {
+			fmt.Print(s)
+			fmt.Println(s.Goroutines)
+			os.Exit(1)
+		},
+	}
+	// Balance has a timeout of 10s clause to exit, but it cannot run when the balancer is blocked in dispatch
 	go b.Balance(wp, r, comp)
 
 	var wg sync.WaitGroup
@@ -0,0 +1,273 @@
+// Command replay feeds a recorded trace through a Balancer and reports latency per key and the
+// requests whose results differ from the recorded ones.
+//
+//	go run ./cmd/replay -trace incident.jsonl -workers 8
+//	go run ./cmd/replay -trace incident.jsonl -speed 10 -format json
+//	go run ./cmd/replay -trace incident.jsonl -strategy round-robin
+//	go run ./cmd/replay -trace incident.jsonl -tenant-rate 50 -tenant-burst 20
+//	go run ./cmd/replay -trace incident.jsonl -fair-depth 100
+//
+// The key of an entry is the tenant of its request, so -tenant-rate limits each key with a token bucket.
+// With -fair-depth the balancer queues the requests of each key in a FairQueue, weighted by the highest
+// priority recorded for the key, so keys with a larger priority get a larger share of a saturated pool.
+//
+// With -speed both arrival offsets and service times are divided by the speed, so the load on the
+// pool stays the same while the replay finishes sooner. Latencies are reported in the time of the
+// trace, so runs at different speeds can be compared.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lb "funmech.com/loadbalancer"
+	"funmech.com/loadbalancer/internal/hist"
+)
+
+type config struct {
+	trace    string
+	speed    float64
+	workers  int
+	buffer   int
+	format   string
+	strategy string
+
+	tenantRate, globalRate   float64
+	tenantBurst, globalBurst int
+	fairDepth                int
+}
+
+func main() {
+	var c config
+	flag.StringVar(&c.trace, "trace", "", "trace file of JSON lines")
+	flag.Float64Var(&c.speed, "speed", 1, "replay speed, 2 replays twice as fast as recorded")
+	flag.IntVar(&c.workers, "workers", 4, "number of workers in the pool")
+	flag.IntVar(&c.buffer, "buffer", 16, "size of the request channel of each worker")
+	flag.StringVar(&c.format, "format", "text", "report format: text or json")
+	flag.StringVar(&c.strategy, "strategy", "least-pending", "strategy of the balancer: "+strings.Join(lb.StrategyNames(), ", "))
+	flag.Float64Var(&c.tenantRate, "tenant-rate", 0, "requests per second allowed for each key, 0 for no limit")
+	flag.IntVar(&c.tenantBurst, "tenant-burst", 10, "burst allowed for each key")
+	flag.Float64Var(&c.globalRate, "global-rate", 0, "requests per second allowed in total, 0 for no limit")
+	flag.IntVar(&c.globalBurst, "global-burst", 100, "burst allowed in total")
+	flag.IntVar(&c.fairDepth, "fair-depth", 0, "queue each key in a fair queue of this depth, weighted by its priority, 0 for no fair queue")
+	flag.Parse()
+
+	if c.trace == "" {
+		log.Fatal("-trace is required")
+	}
+	f, err := os.Open(c.trace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := lb.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("trace %s: %v", c.trace, err)
+	}
+
+	rep, err := replay(entries, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch c.format {
+	case "json":
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		err = e.Encode(rep)
+	default:
+		err = rep.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// stats collects the outcome of the requests of one key.
+type stats struct {
+	hist       hist.Histogram
+	mismatches int
+	rejected   int
+}
+
+type report struct {
+	Entries    int         `json:"entries"`
+	Mismatches int         `json:"mismatches"`
+	Rejected   int         `json:"rejected"`
+	Elapsed    float64     `json:"elapsed_s"`
+	Speed      float64     `json:"speed"`
+	Strategy   string      `json:"strategy"`
+	Overall    keyReport   `json:"overall"`
+	Keys       []keyReport `json:"keys"`
+}
+
+// keyReport summarises the requests of a key. Latencies are in milliseconds of trace time.
+type keyReport struct {
+	Key        string  `json:"key"`
+	Count      int64   `json:"count"`
+	Mismatches int     `json:"mismatches"`
+	Rejected   int     `json:"rejected"`
+	Mean       float64 `json:"mean_ms"`
+	P50        float64 `json:"p50_ms"`
+	P90        float64 `json:"p90_ms"`
+	P99        float64 `json:"p99_ms"`
+	Max        float64 `json:"max_ms"`
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func summarise(key string, s *stats) keyReport {
+	h := &s.hist
+	return keyReport{
+		Key:        key,
+		Count:      h.Count(),
+		Mismatches: s.mismatches,
+		Rejected:   s.rejected,
+		Mean:       ms(h.Mean()),
+		P50:        ms(h.Quantile(0.5)),
+		P90:        ms(h.Quantile(0.9)),
+		P99:        ms(h.Quantile(0.99)),
+		Max:        ms(h.Max()),
+	}
+}
+
+func replay(entries []lb.TraceEntry, c config) (report, error) {
+	if c.speed <= 0 {
+		return report{}, fmt.Errorf("speed has to be positive, got %v", c.speed)
+	}
+	if c.workers < 1 {
+		return report{}, fmt.Errorf("need at least one worker, got %d", c.workers)
+	}
+	strategy, err := lb.NewStrategy(c.strategy)
+	if err != nil {
+		return report{}, err
+	}
+	scale := func(d time.Duration) time.Duration { return time.Duration(float64(d) / c.speed) }
+
+	wp := make(lb.Pool, c.workers)
+	for i := range wp {
+		w := lb.NewWorker(make(chan lb.Request, c.buffer))
+		wp[i] = &w
+	}
+	// A worker finding comp full waits for the balancer, which may be waiting in dispatch for that worker.
+	// Each entry is sent once and completes at most once, so with room for all of them nobody waits.
+	comp := make(chan *lb.Worker, len(entries))
+	var workers sync.WaitGroup
+	for _, w := range wp {
+		workers.Add(1)
+		go func(w *lb.Worker) {
+			defer workers.Done()
+			w.Work(comp)
+		}(w)
+	}
+	r := make(chan lb.Request)
+	b := lb.Balancer{Out: io.Discard, Timeout: 24 * time.Hour, Strategy: strategy}
+	if c.tenantRate > 0 {
+		b.Limiter = lb.NewTokenBucket(c.tenantRate*c.speed, c.tenantBurst)
+	}
+	if c.globalRate > 0 {
+		b.GlobalLimiter = lb.NewTokenBucket(c.globalRate*c.speed, c.globalBurst)
+	}
+	if c.fairDepth > 0 {
+		b.FairQueue = lb.NewFairQueue(weights(entries), c.fairDepth)
+	}
+	go b.Balance(wp, r, comp)
+
+	var mu sync.Mutex
+	all := new(stats)
+	byKey := make(map[string]*stats)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, e := range entries {
+		at := start.Add(scale(e.Offset))
+		time.Sleep(time.Until(at))
+		task := lb.TraceEntry{Service: scale(e.Service), Result: e.Result}.Task()
+		wg.Add(1)
+		go func(e lb.TraceEntry) {
+			defer wg.Done()
+			res, errc := make(chan int, 1), make(chan error, 1)
+			r <- lb.Request{Fn: task, Result: res, Err: errc, Tenant: e.Key}
+			var got int
+			var err error
+			select {
+			case got = <-res:
+			case err = <-errc:
+			}
+			// back to the time of the trace
+			latency := time.Duration(float64(time.Since(at)) * c.speed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			s := byKey[e.Key]
+			if s == nil {
+				s = new(stats)
+				byKey[e.Key] = s
+			}
+			if err != nil {
+				s.rejected++
+				all.rejected++
+				return
+			}
+			s.hist.Record(latency)
+			all.hist.Record(latency)
+			if got != e.Result {
+				s.mismatches++
+				all.mismatches++
+			}
+		}(e)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(r)
+	workers.Wait()
+
+	rep := report{
+		Entries:    len(entries),
+		Mismatches: all.mismatches,
+		Rejected:   all.rejected,
+		Elapsed:    elapsed.Seconds(),
+		Speed:      c.speed,
+		Strategy:   c.strategy,
+		Overall:    summarise("", all),
+	}
+	for k, s := range byKey {
+		rep.Keys = append(rep.Keys, summarise(k, s))
+	}
+	sort.Slice(rep.Keys, func(i, j int) bool { return rep.Keys[i].Key < rep.Keys[j].Key })
+	return rep, nil
+}
+
+// weights returns the highest priority of each key, the weight of the key in a FairQueue.
+func weights(entries []lb.TraceEntry) map[string]int {
+	w := make(map[string]int)
+	for _, e := range entries {
+		if e.Priority > w[e.Key] {
+			w[e.Key] = e.Priority
+		}
+	}
+	return w
+}
+
+func (r report) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "replayed %d entries with %s at %gx in %.2fs, mismatched results: %d, rejected: %d\n\n",
+		r.Entries, r.Strategy, r.Speed, r.Elapsed, r.Mismatches, r.Rejected)
+	fmt.Fprintf(w, "%-16s %8s %10s %10s %10s %10s %10s %10s %10s\n", "key", "count", "mismatch", "rejected", "mean(ms)", "p50(ms)", "p90(ms)", "p99(ms)", "max(ms)")
+	row := func(k keyReport) {
+		fmt.Fprintf(w, "%-16s %8d %10d %10d %10.3f %10.3f %10.3f %10.3f %10.3f\n", k.Key, k.Count, k.Mismatches, k.Rejected, k.Mean, k.P50, k.P90, k.P99, k.Max)
+	}
+	for _, k := range r.Keys {
+		row(k)
+	}
+	all := r.Overall
+	all.Key = "(all)"
+	row(all)
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,94 @@
+// Command worker runs tasks for a remote load balancer, see loadbalancer.RemoteServer.
+//
+//	go run ./cmd/loadgen -listen localhost:9090 -duration 30s &
+//	go run ./cmd/worker -addr localhost:9090 -buffer 8 -zone eu-1
+//	go run ./cmd/worker -network unix -addr /tmp/lb.sock -caps memory=large
+//
+// It joins the balancer, runs the tasks sent to it one after another and exits when the balancer
+// hangs up. The tasks it knows are:
+//
+//	sleep  the payload is a duration in nanoseconds, it sleeps that long and returns 1
+//	fib    the payload is n, it returns the n-th Fibonacci number
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	lb "funmech.com/loadbalancer"
+)
+
+func main() {
+	network := flag.String("network", "tcp", "network of the balancer: tcp or unix")
+	addr := flag.String("addr", "localhost:9090", "address the balancer takes workers on")
+	buffer := flag.Int("buffer", 16, "size of the request channel of the worker in the balancer")
+	weight := flag.Int("weight", 1, "relative capacity of the worker")
+	zone := flag.String("zone", "", "zone the worker runs in")
+	region := flag.String("region", "", "region the worker runs in")
+	host := flag.String("host", "", "host the worker runs on, the host name by default")
+	caps := flag.String("caps", "", "comma separated capabilities, like gpu=true,memory=large")
+	flag.Parse()
+
+	if *host == "" {
+		*host, _ = os.Hostname()
+	}
+	capabilities, err := parseCaps(*caps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := net.Dial(*network, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a := &lb.Agent{
+		Registry:     tasks(),
+		Buffer:       *buffer,
+		Weight:       *weight,
+		Labels:       lb.Labels{Zone: *zone, Region: *region, Host: *host},
+		Capabilities: capabilities,
+	}
+	id, err := a.Run(c)
+	if err != nil {
+		log.Fatalf("worker %d: %v", id, err)
+	}
+	log.Printf("worker %d: the balancer has hung up", id)
+}
+
+func tasks() *lb.Registry {
+	r := lb.NewRegistry()
+	lb.Handle(r, "sleep", lb.JSON, func(d time.Duration) (int, error) {
+		time.Sleep(d)
+		return 1, nil
+	})
+	lb.Handle(r, "fib", lb.JSON, func(n int) (int, error) {
+		if n < 0 {
+			return 0, fmt.Errorf("fib of negative %d", n)
+		}
+		a, b := 0, 1
+		for i := 0; i < n; i++ {
+			a, b = b, a+b
+		}
+		return a, nil
+	})
+	return r
+}
+
+func parseCaps(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	caps := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("capability %q is not like key=value", kv)
+		}
+		caps[k] = v
+	}
+	return caps, nil
+}
@@ -0,0 +1,239 @@
+package loadbalancer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrStopped is returned by the control methods once Balance has returned.
+	ErrStopped = errors.New("balancer has stopped")
+	// ErrNoWorker is returned when there is no Worker with the given ID.
+	ErrNoWorker = errors.New("no such worker")
+	// ErrUnavailable is sent to Request.Err when no Worker can take the request, because all groups are unhealthy.
+	ErrUnavailable = errors.New("no worker available")
+	// ErrNoStrategy is returned by SetStrategy for a nil Strategy or a nil pointer to one.
+	ErrNoStrategy = errors.New("no strategy")
+	// ErrWorkerClosed is sent to Request.Err when the Worker it was sent to has been closed meanwhile.
+	ErrWorkerClosed = errors.New("worker closed")
+)
+
+// WorkerInfo describes a Worker of a running Balancer.
+type WorkerInfo struct {
+	ID       int    `json:"id"`
+	Index    int    `json:"index"` // index in the heap, -1 when the Worker takes no new requests
+	Pending  int    `json:"pending"`
+	QueueLen int    `json:"queue_len"`
+	QueueCap int    `json:"queue_cap"`
+	Health   Health `json:"health"`
+	Weight   int    `json:"weight"`
+	Labels   Labels `json:"labels"`
+	// Capabilities tell which requests the Worker can take, see Request.Selector.
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+	// InFlight has the ages of the pending requests since they were dispatched, the oldest first.
+	InFlight []time.Duration `json:"in_flight_ns"`
+}
+
+// Snapshot is a consistent copy of the state of a Balancer at a point of time.
+// It shares nothing with the Balancer, so it can be kept and read freely.
+type Snapshot struct {
+	Time       time.Time    `json:"time"`
+	Paused     bool         `json:"paused"`
+	Strategy   string       `json:"strategy"`
+	Pending    int          `json:"pending"`    // total count of pending requests
+	Dispatched int          `json:"dispatched"` // count of requests taken by the balancer
+	Completed  int          `json:"completed"`  // count of requests completed by the workers
+	Rejected   int          `json:"rejected"`   // count of requests refused, e.g. by the limiters
+	Workers    []WorkerInfo `json:"workers"`    // in the order of their IDs
+	Tenants    []TenantInfo `json:"tenants"`    // the fair queues in the order of tenants, when there is a FairQueue
+	Zones      []ZoneInfo   `json:"zones"`      // the zones requests have preferred, in the order of zones
+}
+
+func (b *Balancer) init() {
+	b.once.Do(func() {
+		b.ctl = make(chan func())
+		b.done = make(chan struct{})
+	})
+}
+
+// do runs f in the goroutine running Balance and returns its error.
+// It waits until the balancer is ready to run f, which is never while it is blocked in dispatch,
+// so ctx should have a deadline.
+func (b *Balancer) do(ctx context.Context, f func() error) error {
+	b.init()
+	errc := make(chan error, 1)
+	select {
+	case b.ctl <- func() { errc <- f() }:
+		return <-errc
+	case <-b.done:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops the balancer from taking new requests, pending requests still complete.
+func (b *Balancer) Pause(ctx context.Context) error {
+	return b.do(ctx, func() error {
+		b.paused = true
+		return nil
+	})
+}
+
+// Resume undoes Pause.
+func (b *Balancer) Resume(ctx context.Context) error {
+	return b.do(ctx, func() error {
+		b.paused = false
+		return nil
+	})
+}
+
+// SetStrategy changes how the balancer picks Workers from now on.
+// A nil Strategy, or a nil pointer of a Strategy type, is refused with ErrNoStrategy and the current one is kept.
+func (b *Balancer) SetStrategy(ctx context.Context, s Strategy) error {
+	if s == nil {
+		return ErrNoStrategy
+	}
+	if v := reflect.ValueOf(s); v.Kind() == reflect.Pointer && v.IsNil() {
+		return ErrNoStrategy
+	}
+	return b.do(ctx, func() error {
+		b.strategy = s
+		return nil
+	})
+}
+
+// AddWorker adds w to the pool and starts its Work, the caller must not start it. It returns the ID given to w.
+func (b *Balancer) AddWorker(ctx context.Context, w *Worker) (int, error) {
+	err := b.do(ctx, func() error {
+		b.mu.Lock()
+		b.register(w)
+		b.mu.Unlock()
+		b.start(w)
+		return nil
+	})
+	return w.id, err
+}
+
+// start puts w, which has been registered, into the pool and starts its Work.
+func (b *Balancer) start(w *Worker) {
+	b.mu.Lock()
+	defer b.unlock()
+	heap.Push(&b.pool, w)
+	b.joined(w)
+	go w.Work(b.complete)
+	b.hold(Event{Kind: WorkerAdded, Worker: w.id})
+}
+
+// DrainWorker stops sending new requests to the Worker with the given ID. It stays with the balancer,
+// so it can still be inspected, and it is shut down with the others.
+func (b *Balancer) DrainWorker(ctx context.Context, id int) error {
+	return b.do(ctx, func() error {
+		return b.takeOut(id, Draining)
+	})
+}
+
+// RemoveWorker stops sending new requests to the Worker with the given ID and shuts it down
+// once its pending requests have completed.
+func (b *Balancer) RemoveWorker(ctx context.Context, id int) error {
+	return b.do(ctx, func() error {
+		if err := b.takeOut(id, Removing); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		defer b.unlock()
+		if w := b.workers[id]; w.pending == 0 {
+			b.retire(w)
+		}
+		return nil
+	})
+}
+
+// EjectWorker takes the Worker with the given ID out of the balancer at once, because it has failed for
+// the reason of err. Its request channel is closed and the balancer does not wait for its pending requests.
+func (b *Balancer) EjectWorker(ctx context.Context, id int, err error) error {
+	return b.do(ctx, func() error {
+		if err := b.takeOut(id, Removing); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		defer b.unlock()
+		w := b.workers[id]
+		w.close()
+		delete(b.workers, id)
+		b.hold(Event{Kind: WorkerEjected, Worker: id, Err: err})
+		return nil
+	})
+}
+
+// takeOut takes the Worker out of the heap and sets its health.
+func (b *Balancer) takeOut(id int, h Health) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, ok := b.workers[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNoWorker, id)
+	}
+	if w.index >= 0 {
+		heap.Remove(&b.pool, w.index)
+		b.left(w)
+	}
+	if w.health < h {
+		w.health = h
+	}
+	return nil
+}
+
+// Snapshot asks the balancer goroutine for a copy of its state. Like the other control methods,
+// it waits while the balancer is blocked in dispatch, so ctx should have a deadline.
+func (b *Balancer) Snapshot(ctx context.Context) (Snapshot, error) {
+	var s Snapshot
+	err := b.do(ctx, func() error {
+		s = b.snapshot()
+		return nil
+	})
+	return s, err
+}
+
+// snapshot has to run in the balancer goroutine.
+func (b *Balancer) snapshot() Snapshot {
+	s := Snapshot{
+		Time:       time.Now(),
+		Paused:     b.paused,
+		Strategy:   b.strategy.Name(),
+		Pending:    b.pending,
+		Dispatched: b.dispatched,
+		Completed:  b.completions,
+		Rejected:   b.rejected,
+		Workers:    make([]WorkerInfo, 0, len(b.workers)),
+	}
+	for _, w := range b.workers {
+		info := WorkerInfo{
+			ID:           w.id,
+			Index:        w.index,
+			Pending:      w.pending,
+			QueueLen:     w.queued(),
+			QueueCap:     w.capacity(),
+			Health:       w.health,
+			Weight:       w.getWeight(),
+			Labels:       w.labels,
+			Capabilities: copyCaps(w.caps),
+			InFlight:     make([]time.Duration, w.sent.Len()),
+		}
+		for i := range info.InFlight {
+			info.InFlight[i] = s.Time.Sub(w.sent.At(i))
+		}
+		s.Workers = append(s.Workers, info)
+	}
+	sort.Slice(s.Workers, func(i, j int) bool { return s.Workers[i].ID < s.Workers[j].ID })
+	if b.FairQueue != nil {
+		s.Tenants = b.FairQueue.infos()
+	}
+	s.Zones = b.zoneInfos()
+	return s
+}
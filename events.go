@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind tells what has happened in a Balancer.
+type EventKind int
+
+const (
+	RequestAccepted   EventKind = iota // the balancer has taken a request
+	RequestRejected                    // the balancer has refused a request because of Err
+	RequestDispatched                  // a request has been sent to Worker
+	RequestCompleted                   // Worker has completed a request in Duration since it was dispatched, Err when it has failed
+	WorkerAdded                        // Worker has joined the balancer
+	WorkerRemoved                      // Worker has been shut down after it had completed its requests
+	WorkerEjected                      // Worker has been taken out at once because of Err, its pending requests are lost
+	Shutdown                           // Balance has returned
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case RequestAccepted:
+		return "RequestAccepted"
+	case RequestRejected:
+		return "RequestRejected"
+	case RequestDispatched:
+		return "RequestDispatched"
+	case RequestCompleted:
+		return "RequestCompleted"
+	case WorkerAdded:
+		return "WorkerAdded"
+	case WorkerRemoved:
+		return "WorkerRemoved"
+	case WorkerEjected:
+		return "WorkerEjected"
+	case Shutdown:
+		return "Shutdown"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is something which has happened in a Balancer. Fields which do not apply to the Kind are zero.
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Worker   int           // ID of the Worker
+	Duration time.Duration // RequestCompleted: time since the request was dispatched
+	Err      error         // why a request was rejected or failed, or a Worker was ejected
+}
+
+func (e Event) String() string {
+	s := e.Time.Format("15:04:05.000") + " " + e.Kind.String()
+	if e.Worker != 0 {
+		s += fmt.Sprintf(" worker=%d", e.Worker)
+	}
+	if e.Duration != 0 {
+		s += fmt.Sprintf(" duration=%v", e.Duration)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(" err=%q", e.Err)
+	}
+	return s
+}
+
+// An Observer receives the events of a Balancer, see Balancer.Observe.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(Event)
+
+func (f ObserverFunc) Observe(e Event) { f(e) }
+
+// LogObserver returns an Observer which writes every event as a line to w.
+func LogObserver(w io.Writer) Observer {
+	return ObserverFunc(func(e Event) { fmt.Fprintln(w, e) })
+}
+
+// Subscription delivers events to an Observer in its own goroutine.
+type Subscription struct {
+	events  chan Event
+	dropped atomic.Int64
+	b       *Balancer
+	once    sync.Once
+	done    chan struct{}
+}
+
+// Observe delivers the events of b to o in order, from a goroutine of its own. The balancer never waits for
+// an observer: up to buffer events are queued for o and events which do not fit are dropped and counted.
+// The Subscription ends after the Shutdown event or when it is closed.
+func (b *Balancer) Observe(o Observer, buffer int) *Subscription {
+	s := &Subscription{events: make(chan Event, buffer), b: b, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for e := range s.events {
+			o.Observe(e)
+		}
+	}()
+	b.omu.Lock()
+	b.observers = append(b.observers, s)
+	b.omu.Unlock()
+	return s
+}
+
+// Done is closed when the Subscription has ended and the Observer has seen all events delivered to it.
+func (s *Subscription) Done() <-chan struct{} { return s.done }
+
+// Dropped returns the count of events dropped because the Observer was behind.
+func (s *Subscription) Dropped() int64 { return s.dropped.Load() }
+
+// Close stops the delivery and waits until the Observer has seen the events queued before.
+func (s *Subscription) Close() {
+	s.end()
+	<-s.done
+}
+
+func (s *Subscription) end() {
+	s.once.Do(func() {
+		b := s.b
+		b.omu.Lock()
+		for i, o := range b.observers {
+			if o == s {
+				b.observers = append(b.observers[:i], b.observers[i+1:]...)
+				break
+			}
+		}
+		b.omu.Unlock()
+		close(s.events)
+	})
+}
+
+// emit sends e to all observers without waiting, and publishes it to Events.
+func (b *Balancer) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.omu.Lock()
+	for _, s := range b.observers {
+		select {
+		case s.events <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	b.omu.Unlock()
+	if b.Events != nil {
+		b.Events.Publish(e.Kind.String(), e)
+	}
+}
+
+// hold keeps e, which happens while mu is held, to be emitted by unlock: neither a slow observer nor a
+// Hub blocked on its subscribers holds up the goroutines waiting for mu, like the watchdog.
+func (b *Balancer) hold(e Event) {
+	e.Time = time.Now()
+	b.held = append(b.held, e)
+}
+
+// unlock releases mu and emits the events held meanwhile.
+func (b *Balancer) unlock() {
+	b.mu.Unlock()
+	for i, e := range b.held {
+		b.emit(e)
+		b.held[i] = Event{} // drop the reference to Err
+	}
+	b.held = b.held[:0]
+}
+
+// endObservers ends all subscriptions once Balance has returned, it does not wait for the observers.
+func (b *Balancer) endObservers() {
+	b.omu.Lock()
+	subs := append([]*Subscription(nil), b.observers...)
+	b.omu.Unlock()
+	for _, s := range subs {
+		s.end()
+	}
+}
@@ -0,0 +1,195 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"funmech.com/loadbalancer/pubsub"
+)
+
+func TestObserve(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	var kinds []EventKind
+	sub := b.Observe(ObserverFunc(func(e Event) { kinds = append(kinds, e.Kind) }), 16)
+
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	res := make(chan int)
+	r <- Request{Fn: func() int { return 1 }, Result: res}
+	<-res
+	// wait for the completion before shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for s, _ := b.Snapshot(ctx); s.Completed == 0; s, _ = b.Snapshot(ctx) {
+	}
+	close(r)
+	<-sub.Done()
+
+	want := []EventKind{WorkerAdded, RequestAccepted, RequestDispatched, RequestCompleted, WorkerRemoved, Shutdown}
+	if len(kinds) != len(want) {
+		t.Fatalf("events = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("events = %v, want %v", kinds, want)
+		}
+	}
+	if sub.Dropped() != 0 {
+		t.Errorf("dropped = %d, want 0", sub.Dropped())
+	}
+}
+
+func TestObserveDrops(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	block := make(chan struct{})
+	var seen int64
+	slow := b.Observe(ObserverFunc(func(Event) { <-block; seen++ }), 0)
+	ejected := make(chan Event, 1)
+	fast := b.Observe(ObserverFunc(func(e Event) {
+		if e.Kind == WorkerEjected {
+			ejected <- e
+		}
+	}), 8)
+	defer fast.Close()
+
+	wp := make(Pool, 2)
+	for i := range wp {
+		w := NewWorker(make(chan Request))
+		wp[i] = &w
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, make(chan *Worker))
+	defer close(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	failure := errors.New("lost")
+	if err := b.EjectWorker(ctx, 1, failure); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EjectWorker(ctx, 1, failure); !errors.Is(err, ErrNoWorker) {
+		t.Errorf("ejecting twice: err = %v, want ErrNoWorker", err)
+	}
+	if e := <-ejected; e.Worker != 1 || e.Err != failure {
+		t.Errorf("event = %v, want worker 1 ejected", e)
+	}
+
+	// Two WorkerAdded and one WorkerEjected have been emitted, the slow observer can hold only one of them.
+	close(block)
+	slow.Close()
+	if d := slow.Dropped(); d < 2 || seen+d != 3 {
+		t.Errorf("seen = %d, dropped = %d, want 3 events with at least 2 dropped", seen, d)
+	}
+}
+
+func TestEventsHub(t *testing.T) {
+	hub := &pubsub.Hub[Event]{}
+	b := &Balancer{Out: io.Discard, Events: hub}
+	completed := hub.Subscribe(RequestCompleted.String(), 16, pubsub.Drop)
+	all := hub.Subscribe(pubsub.All, 64, pubsub.Drop)
+
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	done := make(chan struct{})
+	go func() {
+		b.Balance(Pool{&w}, r, comp)
+		close(done)
+	}()
+	res := make(chan int)
+	r <- Request{Fn: func() int { return 1 }, Result: res}
+	<-res
+	if e := <-completed.C(); e.Kind != RequestCompleted || e.Worker != w.ID() {
+		t.Errorf("event = %v, want RequestCompleted of worker %d", e, w.ID())
+	}
+	close(r)
+	<-done
+	hub.Close()
+
+	var kinds []EventKind
+	for e := range all.C() {
+		kinds = append(kinds, e.Kind)
+	}
+	if len(kinds) == 0 || kinds[len(kinds)-1] != Shutdown {
+		t.Errorf("events = %v, want them all up to Shutdown", kinds)
+	}
+}
+
+func TestEventsCompletedErr(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	completed := make(chan Event, 2)
+	sub := b.Observe(ObserverFunc(func(e Event) {
+		if e.Kind == RequestCompleted {
+			completed <- e
+		}
+	}), 16)
+
+	failure := errors.New("broken")
+	reg := NewRegistry()
+	reg.Register("fail", func([]byte) (int, error) { return 0, failure })
+	reg.Register("ok", func([]byte) (int, error) { return 1, nil })
+
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+
+	req := reg.Request(Task{Name: "fail"})
+	req.Result, req.Err = make(chan int, 1), make(chan error, 1)
+	r <- req
+	if err := <-req.Err; err != failure {
+		t.Fatalf("err = %v, want %v", err, failure)
+	}
+	if e := <-completed; e.Err != failure {
+		t.Errorf("event = %v, want the failure of the task", e)
+	}
+
+	req = reg.Request(Task{Name: "ok"})
+	req.Result = make(chan int, 1)
+	r <- req
+	<-req.Result
+	if e := <-completed; e.Err != nil {
+		t.Errorf("event = %v, want no error", e)
+	}
+	close(r)
+	<-sub.Done()
+}
+
+// TestEventsOutsideLock checks that a subscriber holding up the balancer does not hold up the watchdog too.
+func TestEventsOutsideLock(t *testing.T) {
+	hub := &pubsub.Hub[Event]{}
+	stalls := make(chan Stall, 1)
+	b := &Balancer{
+		Out:          io.Discard,
+		Events:       hub,
+		StallTimeout: 50 * time.Millisecond,
+		OnStall:      func(s Stall) { stalls <- s },
+	}
+	stuck := hub.Subscribe(RequestDispatched.String(), 0, pubsub.Block)
+	defer stuck.Unsubscribe()
+
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+	r <- Request{Fn: func() int { return 1 }, Result: make(chan int, 1)}
+
+	select {
+	case s := <-stalls:
+		if s.Kind != NoProgress || s.Pending != 1 {
+			t.Errorf("stall = %v, want no progress with one pending request", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watchdog is held up by the blocked subscriber")
+	}
+}
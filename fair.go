@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"funmech.com/loadbalancer/queue"
+)
+
+// ErrQueueFull is sent to Request.Err when the fair queue of its tenant is full.
+var ErrQueueFull = errors.New("tenant queue is full")
+
+// FairQueue shares the workers between tenants when they are saturated. With Balancer.FairQueue set,
+// the balancer keeps accepted requests in a queue per Request.Tenant and dispatches them only to workers
+// with room in their request channels, so it never blocks in dispatch. The queues are served by deficit
+// round-robin: in each round a tenant may dispatch as many requests as its weight, so each tenant gets
+// its weight's share of the dispatch slots while it has requests waiting.
+//
+// A FairQueue keeps the state of the queues, it cannot be shared by Balancers.
+type FairQueue struct {
+	weights  map[string]int
+	maxDepth int
+
+	queues map[string]*tenantQueue
+	active []*tenantQueue // tenants with queued requests in round-robin order
+	cur    int            // index in active of the tenant whose turn it is
+	length int            // total count of queued requests
+}
+
+type tenantQueue struct {
+	name    string
+	weight  int
+	deficit int // dispatch slots left in the current turn
+	items   queue.Ring[queued]
+
+	// statistics
+	dispatched int
+	rejected   int
+	waited     time.Duration // total time the dispatched requests have waited
+	maxWait    time.Duration
+}
+
+type queued struct {
+	req Request
+	at  time.Time
+}
+
+// TenantInfo describes the fair queue of a tenant.
+type TenantInfo struct {
+	Tenant     string        `json:"tenant"`
+	Weight     int           `json:"weight"`
+	Queued     int           `json:"queued"`     // count of requests waiting
+	Dispatched int           `json:"dispatched"` // count of requests sent to workers
+	Rejected   int           `json:"rejected"`   // count of requests refused because the queue was full
+	MeanWait   time.Duration `json:"mean_wait_ns"`
+	MaxWait    time.Duration `json:"max_wait_ns"`
+}
+
+// NewFairQueue returns a FairQueue. A tenant missing from weights has the weight of 1.
+// When maxDepth is positive, requests of a tenant which already has maxDepth requests waiting are
+// rejected with ErrQueueFull.
+func NewFairQueue(weights map[string]int, maxDepth int) *FairQueue {
+	return &FairQueue{weights: weights, maxDepth: maxDepth, queues: make(map[string]*tenantQueue)}
+}
+
+func (f *FairQueue) queue(tenant string) *tenantQueue {
+	q, ok := f.queues[tenant]
+	if !ok {
+		q = &tenantQueue{name: tenant, weight: f.weights[tenant]}
+		if q.weight < 1 {
+			q.weight = 1
+		}
+		f.queues[tenant] = q
+	}
+	return q
+}
+
+// push queues req, it returns false when the queue of the tenant is full.
+func (f *FairQueue) push(req Request, now time.Time) bool {
+	q := f.queue(req.Tenant)
+	if f.maxDepth > 0 && q.items.Len() >= f.maxDepth {
+		q.rejected++
+		return false
+	}
+	if q.items.Len() == 0 {
+		f.active = append(f.active, q)
+	}
+	q.items.Push(queued{req, now})
+	f.length++
+	return true
+}
+
+// pop takes the next request in deficit round-robin order, the queue must not be empty.
+// Every request costs one slot, a tenant gets as many slots as its weight when its turn starts.
+func (f *FairQueue) pop(now time.Time) Request {
+	q := f.active[f.cur]
+	if q.deficit <= 0 {
+		q.deficit = q.weight
+	}
+	it := q.items.Pop()
+	q.deficit--
+	f.length--
+
+	wait := now.Sub(it.at)
+	q.dispatched++
+	q.waited += wait
+	if wait > q.maxWait {
+		q.maxWait = wait
+	}
+
+	switch {
+	case q.items.Len() == 0:
+		// it leaves the round, the next tenant moves into its place
+		q.deficit = 0
+		f.active = append(f.active[:f.cur], f.active[f.cur+1:]...)
+		if f.cur >= len(f.active) {
+			f.cur = 0
+		}
+	case q.deficit == 0:
+		f.cur = (f.cur + 1) % len(f.active)
+	}
+	return it.req
+}
+
+// peek returns the request pop would take, the queue must not be empty.
+func (f *FairQueue) peek() Request {
+	return f.active[f.cur].items.Peek().req
+}
+
+// skip passes the turn on to the next tenant while the one whose turn it is cannot dispatch its next request.
+// It keeps its deficit, so when none of them can, the turn comes back to it as it was.
+func (f *FairQueue) skip() {
+	f.cur = (f.cur + 1) % len(f.active)
+}
+
+// Len returns the count of queued requests of all tenants.
+func (f *FairQueue) Len() int { return f.length }
+
+// drainAll removes all queued requests.
+func (f *FairQueue) drainAll() []Request {
+	var reqs []Request
+	for _, q := range f.active {
+		for q.items.Len() > 0 {
+			reqs = append(reqs, q.items.Pop().req)
+		}
+		q.deficit = 0
+	}
+	f.active, f.cur, f.length = nil, 0, 0
+	return reqs
+}
+
+func (f *FairQueue) infos() []TenantInfo {
+	infos := make([]TenantInfo, 0, len(f.queues))
+	for _, q := range f.queues {
+		info := TenantInfo{
+			Tenant:     q.name,
+			Weight:     q.weight,
+			Queued:     q.items.Len(),
+			Dispatched: q.dispatched,
+			Rejected:   q.rejected,
+			MaxWait:    q.maxWait,
+		}
+		if q.dispatched > 0 {
+			info.MeanWait = q.waited / time.Duration(q.dispatched)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Tenant < infos[j].Tenant })
+	return infos
+}
+
+// roomy returns the Worker for req among its candidates which can take it without blocking the balancer,
+// chosen like pick chooses among all of them, or nil when they are all full. A copy of a scattered request
+// does not go to a Worker running another copy. A Worker holds one request in hand and the rest in its channel.
+func (b *Balancer) roomy(req Request) *Worker {
+	p := b.candidates(req)
+	room := b.room[:0]
+	for _, w := range p {
+		if w.pending <= w.capacity() && w.available() && !req.siblings[w] {
+			room = append(room, w)
+		}
+	}
+	b.room = room
+	if len(room) == 0 {
+		return nil
+	}
+	if len(room) < len(p) {
+		// Leaving out the full ones can break the heap order LeastPending relies on, sorted it is a heap again.
+		// sort.Slice swaps without Pool.Swap, so the indices of the Workers in the pool are kept.
+		sort.Slice(room, func(i, j int) bool { return lighter(room[i], room[j]) })
+	}
+	return b.pick(req, room)
+}
+
+// drain dispatches queued requests while there are workers with room for them. A request waits in front of
+// the others of its tenant until a Worker matching its Selector, and not running a copy of it, has room,
+// meanwhile the other tenants take their turns.
+func (b *Balancer) drain() {
+	f := b.FairQueue
+	// blocked counts the tenants in a row whose next request has no room, all of them when it reaches len(f.active)
+	for blocked := 0; f.Len() > 0 && blocked < len(f.active); {
+		w := b.roomy(f.peek())
+		if w == nil {
+			f.skip()
+			blocked++
+			continue
+		}
+		blocked = 0
+		req := f.pop(time.Now())
+		if req.siblings != nil {
+			req.siblings[w] = true
+		}
+		b.dispatch(req, w)
+	}
+}
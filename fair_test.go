@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFairQueueOrder(t *testing.T) {
+	f := NewFairQueue(map[string]int{"a": 2}, 0)
+	now := time.Unix(0, 0)
+	for i := 0; i < 4; i++ {
+		f.push(Request{Tenant: "a"}, now)
+		f.push(Request{Tenant: "b"}, now)
+	}
+	f.push(Request{Tenant: "c"}, now)
+	var got []string
+	for f.Len() > 0 {
+		got = append(got, f.pop(now).Tenant)
+	}
+	// a has twice the share of b and c while they all have requests waiting
+	if s := strings.Join(got, ""); s != "aabcaabbb" {
+		t.Errorf("order = %s, want aabcaabbb", s)
+	}
+}
+
+func TestFairQueueFull(t *testing.T) {
+	f := NewFairQueue(nil, 1)
+	now := time.Unix(0, 0)
+	if !f.push(Request{Tenant: "a"}, now) || !f.push(Request{Tenant: "b"}, now) {
+		t.Fatal("request rejected by an empty queue")
+	}
+	if f.push(Request{Tenant: "a"}, now) {
+		t.Error("request accepted by a full queue")
+	}
+	f.pop(now.Add(time.Second))
+	infos := f.infos()
+	if len(infos) != 2 || infos[0].Queued != 0 || infos[0].Rejected != 1 || infos[0].MaxWait != time.Second || infos[1].Queued != 1 {
+		t.Errorf("infos = %+v", infos)
+	}
+}
+
+func TestBalancerFairQueue(t *testing.T) {
+	b := &Balancer{Out: io.Discard, FairQueue: NewFairQueue(map[string]int{"big": 3}, 8)}
+	w := NewWorker(make(chan Request))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+
+	gate := make(chan struct{})
+	ran := make(chan string, 16)
+	res, errc := make(chan int, 16), make(chan error, 16)
+	send := func(tenant string) {
+		r <- Request{Fn: func() int { <-gate; ran <- tenant; return 0 }, Result: res, Err: errc, Tenant: tenant}
+	}
+	// The first request keeps the only worker busy, the others have to wait in the queues.
+	send("small")
+	for i := 0; i < 6; i++ {
+		send("big")
+	}
+	for i := 0; i < 3; i++ {
+		send("small")
+	}
+
+	s, err := b.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tenants) != 2 || s.Tenants[0].Queued != 6 || s.Tenants[1].Queued != 3 {
+		t.Errorf("tenants = %+v, want 6 queued for big and 3 for small", s.Tenants)
+	}
+	close(gate)
+	var got []string
+	for i := 0; i < 10; i++ {
+		got = append(got, (<-ran)[:1])
+	}
+	close(r)
+	if s := strings.Join(got, ""); s != "sbbbsbbbss" {
+		t.Errorf("order = %s, want sbbbsbbbss", s)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("unexpected error %v", err)
+	default:
+	}
+}
+
+func TestBalancerFairQueueFull(t *testing.T) {
+	b := &Balancer{Out: io.Discard, FairQueue: NewFairQueue(nil, 1)}
+	r := make(chan Request)
+	go b.Balance(nil, r, make(chan *Worker))
+	defer close(r)
+
+	errc := make(chan error, 1)
+	// Without workers, the first request waits in the queue and the second one does not fit.
+	r <- Request{Fn: func() int { return 0 }, Result: make(chan int, 1), Tenant: "a"}
+	r <- Request{Fn: func() int { return 0 }, Result: make(chan int, 1), Err: errc, Tenant: "a"}
+	if err := <-errc; !errors.Is(err, ErrQueueFull) {
+		t.Errorf("err = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestBalancerFairQueueZone(t *testing.T) {
+	b := &Balancer{Out: io.Discard, FairQueue: NewFairQueue(nil, 8)}
+	comp := make(chan *Worker, 4)
+	var wp Pool
+	for _, zone := range []string{"a", "b"} {
+		w := NewWorker(make(chan Request))
+		w.SetLabels(Labels{Zone: zone})
+		wp = append(wp, &w)
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	defer close(r)
+
+	gate := make(chan struct{})
+	defer close(gate)
+	zones := func() []ZoneInfo {
+		s, err := b.Snapshot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Zones
+	}
+	res := make(chan int, 4)
+	// The first goes to b although both are idle, the second finds b full and goes to a rather than wait.
+	r <- Request{Fn: func() int { <-gate; return 1 }, Result: res, Zone: "b"}
+	if got, want := zones(), []ZoneInfo{{Zone: "b", Local: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zones = %+v, want %+v", got, want)
+	}
+	r <- Request{Fn: func() int { <-gate; return 1 }, Result: res, Zone: "b"}
+	if got, want := zones(), []ZoneInfo{{Zone: "a", SpilledIn: 1}, {Zone: "b", Local: 1, SpilledOut: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zones = %+v, want %+v", got, want)
+	}
+}
+
+func TestBalancerFairQueueBlockedTenant(t *testing.T) {
+	b := &Balancer{Out: io.Discard, FairQueue: NewFairQueue(nil, 8)}
+	comp := make(chan *Worker, 4)
+	gpu, cpu := NewWorker(make(chan Request)), NewWorker(make(chan Request))
+	gpu.SetCapabilities(map[string]string{"gpu": "true"})
+	go gpu.Work(comp)
+	go cpu.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&gpu, &cpu}, r, comp)
+	defer close(r)
+
+	gate := make(chan struct{})
+	defer close(gate)
+	res := make(chan int, 4)
+	// The first request of a keeps the only gpu worker busy, so the second one has nowhere to go...
+	for i := 0; i < 2; i++ {
+		r <- Request{Fn: func() int { <-gate; return 1 }, Result: res, Tenant: "a", Selector: Selector{"gpu": "true"}}
+	}
+	// ...which must not hold up b, whose request any worker can take.
+	r <- Request{Fn: func() int { return 2 }, Result: res, Tenant: "b"}
+	select {
+	case v := <-res:
+		if v != 2 {
+			t.Errorf("result = %d, want 2 of tenant b", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tenant b waits behind the blocked tenant a")
+	}
+}
@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPayload is the largest body the frontend takes as the payload of a task.
+const maxPayload = 1 << 20
+
+type frontend struct {
+	reg *Registry
+	r   chan<- Request
+}
+
+// NewFrontend returns an http.Handler through which clients in other processes send requests to a Balancer,
+// whose request channel is r. Every request runs a task of reg:
+//
+//	POST /tasks/{name}  run the task of name, the body is its payload; the response is like {"value": 42}
+//
+// A request rejected by a limiter gets 429 with a Retry-After header, one no Worker can take gets 503 and a task
+// which fails gets 502. A request whose client goes away before the Balancer has taken it is dropped, a request
+// the Balancer has taken is waited for, so a handler returns only once its request has completed.
+// The handler must not be serving any more when r is closed, see http.Server.Shutdown.
+func NewFrontend(reg *Registry, r chan<- Request) http.Handler {
+	return &frontend{reg: reg, r: r}
+}
+
+func (f *frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/tasks/")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayload))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	req := f.reg.Request(Task{Name: name, Payload: payload})
+	req.Result, req.Err = make(chan int, 1), make(chan error, 1)
+	select {
+	case f.r <- req:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case v := <-req.Result:
+		reply(w, http.StatusOK, map[string]int{"value": v})
+	case err := <-req.Err:
+		failTask(w, err)
+	}
+}
+
+// failTask answers a request which has failed with err.
+func failTask(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	var rejected *RejectedError
+	var unknown *UnknownTaskError
+	var noMatch *NoMatchError
+	switch {
+	case errors.As(err, &rejected):
+		status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejected.RetryAfter.Seconds()))))
+	case errors.As(err, &unknown):
+		status = http.StatusNotFound
+	case errors.As(err, &noMatch), errors.Is(err, ErrUnavailable), errors.Is(err, ErrQueueFull),
+		errors.Is(err, ErrStopped), errors.Is(err, ErrWorkerLost), errors.Is(err, ErrWorkerClosed):
+		status = http.StatusServiceUnavailable
+	}
+	reply(w, status, map[string]string{"error": err.Error()})
+}
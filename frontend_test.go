@@ -0,0 +1,60 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closed is a Limiter which allows nothing.
+type closed time.Duration
+
+func (c closed) Allow(string, time.Time) (bool, time.Duration) { return false, time.Duration(c) }
+
+func TestFrontend(t *testing.T) {
+	reg := NewRegistry()
+	Handle(reg, "half", JSON, func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, fmt.Errorf("%d is odd", n)
+		}
+		return n / 2, nil
+	})
+	_, r := running(t, 2)
+	h := NewFrontend(reg, r)
+
+	var got struct{ Value int }
+	call(t, h, "POST", "/tasks/half", "42", http.StatusOK, &got)
+	if got.Value != 21 {
+		t.Errorf("value = %d, want 21", got.Value)
+	}
+	var failed struct{ Error string }
+	call(t, h, "POST", "/tasks/half", "7", http.StatusBadGateway, &failed)
+	if failed.Error != "7 is odd" {
+		t.Errorf("error = %q", failed.Error)
+	}
+	call(t, h, "POST", "/tasks/double", "7", http.StatusNotFound, nil)
+	call(t, h, "GET", "/tasks/half", "", http.StatusMethodNotAllowed, nil)
+	call(t, h, "POST", "/half", "42", http.StatusNotFound, nil)
+}
+
+func TestFrontendRejected(t *testing.T) {
+	reg := NewRegistry()
+	Handle(reg, "half", JSON, func(n int) (int, error) { return n / 2, nil })
+	b := &Balancer{Out: io.Discard, Limiter: closed(1500 * time.Millisecond)}
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+
+	rec := httptest.NewRecorder()
+	NewFrontend(reg, r).ServeHTTP(rec, httptest.NewRequest("POST", "/tasks/half", strings.NewReader("42")))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("status = %d, Retry-After = %q, want 429 and 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,114 @@
+package loadbalancer
+
+import (
+	"context"
+	"sync"
+
+	"funmech.com/loadbalancer/quit"
+)
+
+// group is the pool of Workers behind a Worker made by NewGroup, balanced by a Balancer of its own.
+type group struct {
+	b    *Balancer
+	pool Pool
+}
+
+// NewGroup returns a Worker standing for a whole pool of Workers in zone, so Balancers can be stacked:
+// the parent Balancer sends a request to the least loaded group, then b sends it to the least loaded
+// Worker of the group. The group is one entry in the heap of the parent, its pending is the count of its
+// requests not completed yet and its weight is the total weight of its Workers.
+//
+// The Work of the returned Worker runs b over pool, so the Workers of pool must not be started by the caller,
+// and b can be controlled like any Balancer, e.g. to drain the Workers of the group. The parent passes over
+// a group which has no Worker taking requests, or whose b has stopped, see Request.Zone.
+// Requests may complete out of order in a group, so the durations of its RequestCompleted events are approximate.
+// b stops when the parent closes the group. Unless its Timeout is set, NewGroup sets it to the longest possible,
+// so a group idle for a while still takes requests; a Timeout set by the caller is kept.
+func NewGroup(zone string, b *Balancer, pool Pool) Worker {
+	b.init()
+	if b.Timeout == 0 {
+		b.Timeout = 1<<63 - 1
+	}
+	size, weight := 0, 0
+	for _, w := range pool {
+		size += w.capacity() + 1
+		weight += w.getWeight()
+	}
+	return Worker{
+		// it has room for as many requests as its Workers, so the fair queue sees its capacity
+		request: make(chan Request, size),
+		member:  quit.NewMember(),
+		weight:  weight,
+		labels:  Labels{Zone: zone},
+		group:   &group{b: b, pool: pool},
+	}
+}
+
+// serve runs the Balancer of the group for w and forwards the requests of w to it.
+// Every request is reported done to the parent once it has completed or failed in the group.
+func (g *group) serve(w *Worker, done chan *Worker) {
+	size := 0
+	for _, cw := range g.pool {
+		size += cw.capacity() + 1
+	}
+	req, complete := make(chan Request), make(chan *Worker, size)
+	for _, cw := range g.pool {
+		go cw.Work(complete)
+	}
+	go g.b.Balance(g.pool, req, complete)
+
+	var wg sync.WaitGroup
+	for r := range w.request {
+		result, errc := r.Result, r.Err
+		r.Result, r.Err = make(chan int, 1), make(chan error, 1)
+		wg.Add(1)
+		go func(r Request) {
+			defer wg.Done()
+			var err error
+			select {
+			case v := <-r.Result:
+				result <- v
+			case err = <-r.Err:
+				if errc != nil {
+					errc <- err
+				}
+			}
+			w.finished(done, err)
+		}(r)
+		select {
+		case req <- r:
+		case <-g.b.done:
+			r.Err <- ErrStopped
+		}
+	}
+	wg.Wait()
+	close(req)
+	// b does not receive from req while none of its Workers takes requests, so it is told directly
+	// that no more requests are coming.
+	g.b.do(context.Background(), func() error {
+		g.b.closing = true
+		return nil
+	})
+}
+
+// healthy reports whether the group has a Worker to take requests. It is called by the parent Balancer,
+// which may hold its own mu but never the one of the group.
+func (g *group) healthy() bool {
+	select {
+	case <-g.b.done:
+		return false
+	default:
+	}
+	g.b.mu.Lock()
+	defer g.b.mu.Unlock()
+	if g.b.workers == nil {
+		return len(g.pool) > 0 // not started yet
+	}
+	// the Worker the group is sending to is out of its heap meanwhile
+	return g.b.pool.Len() > 0 || g.b.sending != nil
+}
+
+// available reports whether w can take requests, which is always the case for a Worker in the heap but a group.
+func (w *Worker) available() bool {
+	return w.group == nil || w.group.healthy()
+}
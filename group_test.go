@@ -0,0 +1,149 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// zoned returns a group of n Workers in zone with its Balancer. The Balancer has to stop with the parent
+// of the group, by the end of the test.
+func zoned(t *testing.T, zone string, n int) (*Balancer, *Worker) {
+	t.Helper()
+	b := &Balancer{Out: io.Discard}
+	wp := make(Pool, n)
+	for i := range wp {
+		w := NewWorker(make(chan Request, 2))
+		wp[i] = &w
+	}
+	g := NewGroup(zone, b, wp)
+	t.Cleanup(func() {
+		select {
+		case <-b.done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("the balancer of group %q has not stopped with its parent", zone)
+		}
+	})
+	return b, &g
+}
+
+func TestGroups(t *testing.T) {
+	east, ge := zoned(t, "east", 2)
+	west, gw := zoned(t, "west", 2)
+	b := &Balancer{Out: io.Discard}
+	comp := make(chan *Worker, 16)
+	go ge.Work(comp)
+	go gw.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{ge, gw}, r, comp)
+	defer close(r)
+
+	res, errc := make(chan int, 1), make(chan error, 1)
+	ask := func(zone string) {
+		t.Helper()
+		r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Zone: zone}
+		select {
+		case <-res:
+		case err := <-errc:
+			t.Fatalf("zone %q: %v", zone, err)
+		}
+	}
+	completed := func(b *Balancer) int {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s, err := b.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Completed
+	}
+
+	for i := 0; i < 3; i++ {
+		ask("west")
+	}
+	if e, w := completed(east), completed(west); e != 0 || w != 3 {
+		t.Errorf("completed east %d, west %d, want 0 and 3", e, w)
+	}
+
+	// Without any Worker taking requests in west, its requests fail over to east.
+	ctx := context.Background()
+	for _, id := range []int{1, 2} {
+		if err := west.DrainWorker(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ask("west")
+	if e := completed(east); e != 1 {
+		t.Errorf("completed east %d, want 1", e)
+	}
+
+	for _, id := range []int{1, 2} {
+		if err := east.DrainWorker(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc}
+	if err := <-errc; !errors.Is(err, ErrUnavailable) {
+		t.Errorf("err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestGroupPending(t *testing.T) {
+	_, g := zoned(t, "", 3)
+	if g.getWeight() != 3 {
+		t.Errorf("weight = %d, want 3", g.getWeight())
+	}
+	b := &Balancer{Out: io.Discard}
+	comp := make(chan *Worker, 16)
+	go g.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{g}, r, comp)
+	defer close(r)
+
+	gate := make(chan struct{})
+	res := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		r <- Request{Fn: func() int { <-gate; return 1 }, Result: res}
+	}
+	s, err := b.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Workers[0].Pending != 4 {
+		t.Errorf("pending of the group = %d, want 4", s.Workers[0].Pending)
+	}
+	close(gate)
+	for i := 0; i < 4; i++ {
+		<-res
+	}
+}
+
+func TestGroupIdle(t *testing.T) {
+	gb, g := zoned(t, "", 1)
+	if gb.Timeout != 1<<63-1 {
+		t.Errorf("timeout of the group balancer = %v, want none", gb.Timeout)
+	}
+	set := &Balancer{Timeout: time.Minute}
+	NewGroup("", set, nil)
+	if set.Timeout != time.Minute {
+		t.Errorf("timeout of the group balancer = %v, want the one set, %v", set.Timeout, time.Minute)
+	}
+	b := &Balancer{Out: io.Discard}
+	comp := make(chan *Worker, 4)
+	go g.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{g}, r, comp)
+	defer close(r)
+
+	res := make(chan int, 1)
+	r <- Request{Fn: func() int { return 1 }, Result: res}
+	<-res
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := gb.Snapshot(ctx); err != nil {
+		t.Errorf("the balancer of an idle group: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package hist provides a log-linear latency histogram shared by the load generating commands.
+package hist
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBits decides the precision of the histogram: each power of two range is split into
+// 2^(subBits-1) buckets, so a recorded value is off by less than 1/64 (about 1.6%).
+const subBits = 7
+
+// Histogram is a log-linear latency histogram in the style of HdrHistogram.
+// Values below 2^subBits nanoseconds are counted exactly, larger values fall into buckets whose
+// width grows with the magnitude of the value, so the relative error stays the same
+// from microseconds to minutes while the memory use stays small.
+// The zero value is an empty histogram. It is not safe for concurrent use.
+type Histogram struct {
+	counts   []int64
+	count    int64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+// Bucket is a non-empty bucket of a Histogram: Count values are at or below High but above the previous bucket.
+type Bucket struct {
+	High  time.Duration
+	Count int64
+}
+
+func bucketOf(v int64) int {
+	const sub = 1 << subBits
+	if v < sub {
+		return int(v)
+	}
+	e := bits.Len64(uint64(v)) - subBits
+	return sub + (e-1)*(sub/2) + int(v>>e) - sub/2
+}
+
+// bucketHigh returns the largest value which falls into bucket i.
+func bucketHigh(i int) int64 {
+	const sub = 1 << subBits
+	if i < sub {
+		return int64(i)
+	}
+	e := (i-sub)/(sub/2) + 1
+	m := int64((i-sub)%(sub/2) + sub/2)
+	return (m+1)<<e - 1
+}
+
+// Record adds a value, negative values are counted as zero.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bucketOf(int64(d))
+	for len(h.counts) <= i {
+		h.counts = append(h.counts, 0)
+	}
+	h.counts[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Quantile returns the value at or below which the fraction q of the recorded values are.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if v := time.Duration(bucketHigh(i)); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() int64 { return h.count }
+
+// Min returns the smallest recorded value.
+func (h *Histogram) Min() time.Duration { return h.min }
+
+// Max returns the largest recorded value.
+func (h *Histogram) Max() time.Duration { return h.max }
+
+// Mean returns the average of the recorded values.
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Buckets returns the non-empty buckets in increasing order.
+func (h *Histogram) Buckets() []Bucket {
+	var bs []Bucket
+	for i, c := range h.counts {
+		if c > 0 {
+			bs = append(bs, Bucket{High: time.Duration(bucketHigh(i)), Count: c})
+		}
+	}
+	return bs
+}
@@ -0,0 +1,86 @@
+package hist
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	tests := []struct {
+		v      int64
+		bucket int
+		high   int64
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{127, 127, 127}, // the last value counted exactly
+		{128, 128, 129}, // buckets of 2 from here
+		{129, 128, 129},
+		{130, 129, 131},
+		{255, 191, 255},
+		{256, 192, 259}, // buckets of 4 from here
+		{259, 192, 259},
+		{260, 193, 263},
+		{511, 255, 511},
+		{512, 256, 519},
+	}
+	for _, tt := range tests {
+		if b := bucketOf(tt.v); b != tt.bucket {
+			t.Errorf("bucketOf(%d) = %d, want %d", tt.v, b, tt.bucket)
+		}
+		if h := bucketHigh(tt.bucket); h != tt.high {
+			t.Errorf("bucketHigh(%d) = %d, want %d", tt.bucket, h, tt.high)
+		}
+	}
+}
+
+// TestBucketBounds checks that every value falls into the bucket whose bounds hold it and that the
+// bounds are within the precision of the histogram, across the magnitudes.
+func TestBucketBounds(t *testing.T) {
+	for _, v := range []int64{0, 1, 100, 127, 128, 1000, 4095, 4096, 1e6, 1e9 + 7, 60e9, 1 << 50} {
+		b := bucketOf(v)
+		if h := bucketHigh(b); h < v {
+			t.Errorf("value %d above the high %d of its bucket %d", v, h, b)
+		} else if float64(h-v) > float64(v)/64 {
+			t.Errorf("value %d in bucket %d up to %d, off by more than 1/64", v, b, h)
+		}
+		if b > 0 && bucketHigh(b-1) >= v {
+			t.Errorf("value %d not above the high %d of the bucket before its bucket %d", v, bucketHigh(b-1), b)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	var h Histogram
+	if q := h.Quantile(0.5); q != 0 {
+		t.Errorf("Quantile of an empty histogram = %v, want 0", q)
+	}
+	// 1µs to 1000µs, one of each
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{0.001, time.Microsecond},
+		{0.5, 500 * time.Microsecond},
+		{0.9, 900 * time.Microsecond},
+		{0.99, 990 * time.Microsecond},
+		{1, 1000 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		got := h.Quantile(tt.q)
+		if got < tt.want || math.Abs(float64(got-tt.want)) > float64(tt.want)/64 {
+			t.Errorf("Quantile(%v) = %v, want %v within 1/64", tt.q, got, tt.want)
+		}
+	}
+	if h.Quantile(1) != h.Max() {
+		t.Errorf("Quantile(1) = %v, want the max %v", h.Quantile(1), h.Max())
+	}
+	if m := h.Mean(); m != 500500*time.Nanosecond {
+		t.Errorf("Mean = %v, want 500.5µs", m)
+	}
+}
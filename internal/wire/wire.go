@@ -0,0 +1,128 @@
+// Package wire is the protocol between a Balancer and its remote workers.
+//
+// A frame is a 4-byte big-endian length, then a byte telling the Kind of the message and its body in JSON.
+// The length counts the kind byte and the body.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxFrame is the largest frame accepted, it keeps a broken peer from making the reader allocate without limit.
+const MaxFrame = 16 << 20
+
+// ErrFrameTooLarge is returned when a frame is larger than MaxFrame.
+var ErrFrameTooLarge = errors.New("wire: frame too large")
+
+// Kind tells what a message is.
+type Kind byte
+
+const (
+	KindHello   Kind = iota + 1 // worker → balancer, the first message of a worker: Hello
+	KindWelcome                 // balancer → worker, the answer to Hello: Welcome
+	KindTask                    // balancer → worker: Task
+	KindResult                  // worker → balancer, a Task has been run: Result
+	KindPing                    // balancer → worker, no body
+	KindPong                    // worker → balancer, the answer to Ping, no body
+)
+
+// Hello describes a worker joining a balancer.
+type Hello struct {
+	Buffer       int               `json:"buffer"`
+	Weight       int               `json:"weight"`
+	Zone         string            `json:"zone,omitempty"`
+	Region       string            `json:"region,omitempty"`
+	Host         string            `json:"host,omitempty"`
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+	Tasks        []string          `json:"tasks"` // names of the tasks the worker can run
+}
+
+// Welcome tells a worker the ID the balancer has given to it.
+type Welcome struct {
+	ID int `json:"id"`
+}
+
+// Task asks a worker to run the task of Name with Payload.
+type Task struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"name"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// Result is the outcome of the Task with the same ID, either Value or Err.
+type Result struct {
+	ID    uint64 `json:"id"`
+	Value int    `json:"value"`
+	Err   string `json:"err,omitempty"`
+}
+
+// Conn reads and writes messages. Send may be called from many goroutines, Recv only from one.
+type Conn struct {
+	r  *bufio.Reader
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewConn returns a Conn over rw.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{r: bufio.NewReader(rw), w: rw}
+}
+
+// Send writes a message of kind with the JSON of v as the body, no body when v is nil.
+func (c *Conn) Send(kind Kind, v any) error {
+	var body []byte
+	if v != nil {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	if len(body)+1 > MaxFrame {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)+1))
+	frame[4] = byte(kind)
+	copy(frame[5:], body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// Recv reads the next message and returns its kind and body, decode the body with Decode.
+func (c *Conn) Recv() (Kind, []byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n == 0 {
+		return 0, nil, errors.New("wire: empty frame")
+	}
+	if n > MaxFrame {
+		return 0, nil, ErrFrameTooLarge
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(c.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return Kind(frame[0]), frame[1:], nil
+}
+
+// Decode decodes the body of a message of kind into v.
+func Decode(kind Kind, body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("wire: message of kind %d: %w", kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// A Limiter decides whether a request with a key may be taken at a time. When it may not,
+// retryAfter tells how long to wait before the request would be allowed.
+// The Balancer uses Request.Tenant as the key of Balancer.Limiter and "" for Balancer.GlobalLimiter.
+type Limiter interface {
+	Allow(key string, now time.Time) (ok bool, retryAfter time.Duration)
+}
+
+// A Refunder is a Limiter which can give back a request it has allowed at now. The Balancer refunds the
+// tenant of a request which Balancer.Limiter has allowed and Balancer.GlobalLimiter has rejected, so the
+// tenant is not charged for a request which has not been taken.
+type Refunder interface {
+	Refund(key string, now time.Time)
+}
+
+// RejectedError is sent to Request.Err when the request has been rejected by a Limiter.
+type RejectedError struct {
+	Tenant     string
+	Global     bool          // rejected by the global limit rather than the limit of the tenant
+	RetryAfter time.Duration // when the request would be allowed
+}
+
+func (e *RejectedError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("rate limited globally, retry after %v", e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited for tenant %q, retry after %v", e.Tenant, e.RetryAfter)
+}
+
+// sweepEvery is how many calls of Allow a limiter takes before it forgets idle keys.
+const sweepEvery = 1024
+
+// TokenBucket allows a rate of requests per second for each key on average, and bursts of up to a number of requests.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket whose buckets start full.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+func (t *TokenBucket) Allow(key string, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.calls++; t.calls%sweepEvery == 0 {
+		t.sweep(now)
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if t.rate <= 0 {
+		return false, math.MaxInt64
+	}
+	return false, time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+}
+
+func (t *TokenBucket) Refund(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.buckets[key]; ok {
+		b.tokens = math.Min(t.burst, b.tokens+1)
+	}
+}
+
+// sweep forgets the buckets which are full again, they are the same as new ones.
+func (t *TokenBucket) sweep(now time.Time) {
+	for k, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, k)
+		}
+	}
+}
+
+// SlidingWindow allows a limited number of requests for each key in any period of a time window. It keeps a count of the current
+// and the previous fixed windows and weighs the previous count by how much of it the sliding window still
+// covers, which takes constant memory per key and is accurate when requests arrive evenly.
+type SlidingWindow struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*window
+	calls   int
+}
+
+type window struct {
+	start      time.Time // start of the current fixed window
+	prev, curr int
+}
+
+// NewSlidingWindow returns a SlidingWindow allowing limit requests in any period.
+func NewSlidingWindow(limit int, period time.Duration) *SlidingWindow {
+	return &SlidingWindow{limit: limit, window: period, windows: make(map[string]*window)}
+}
+
+func (s *SlidingWindow) Allow(key string, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls++; s.calls%sweepEvery == 0 {
+		s.sweep(now)
+	}
+	w, ok := s.windows[key]
+	if !ok {
+		w = &window{start: now.Truncate(s.window)}
+		s.windows[key] = w
+	}
+	s.advance(w, now)
+
+	elapsed := now.Sub(w.start)
+	weight := 1 - float64(elapsed)/float64(s.window)
+	if float64(w.prev)*weight+float64(w.curr)+1 <= float64(s.limit) {
+		w.curr++
+		return true, 0
+	}
+	// Wait until enough of the previous window has slid out, or the next window when the current one is full.
+	if w.prev > 0 && w.curr+1 <= s.limit {
+		need := 1 - float64(s.limit-w.curr-1)/float64(w.prev)
+		return false, time.Duration(need*float64(s.window)) - elapsed
+	}
+	return false, s.window - elapsed
+}
+
+func (s *SlidingWindow) Refund(key string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := s.windows[key]; ok {
+		s.advance(w, now)
+		if w.curr > 0 {
+			w.curr--
+		}
+	}
+}
+
+// advance moves the fixed windows of w forward to the one now falls in.
+func (s *SlidingWindow) advance(w *window, now time.Time) {
+	switch n := now.Sub(w.start) / s.window; {
+	case n == 1:
+		w.prev, w.curr = w.curr, 0
+		w.start = w.start.Add(s.window)
+	case n > 1:
+		w.prev, w.curr = 0, 0
+		w.start = now.Truncate(s.window)
+	}
+}
+
+// sweep forgets keys which have had no request for two windows.
+func (s *SlidingWindow) sweep(now time.Time) {
+	for k, w := range s.windows {
+		if now.Sub(w.start) >= 2*s.window {
+			delete(s.windows, k)
+		}
+	}
+}
+
+// admit checks req against the limiters, it returns a *RejectedError when the request is not allowed.
+// A request rejected by the global limit is refunded to the limit of its tenant when it can be.
+func (b *Balancer) admit(req Request, now time.Time) error {
+	if b.Limiter != nil {
+		if ok, after := b.Limiter.Allow(req.Tenant, now); !ok {
+			return &RejectedError{Tenant: req.Tenant, RetryAfter: after}
+		}
+	}
+	if b.GlobalLimiter != nil {
+		if ok, after := b.GlobalLimiter.Allow("", now); !ok {
+			if r, ok := b.Limiter.(Refunder); ok {
+				r.Refund(req.Tenant, now)
+			}
+			return &RejectedError{Tenant: req.Tenant, Global: true, RetryAfter: after}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(10, 2) // a token every 100ms
+	now := time.Unix(0, 0)
+	for i := 0; i < 2; i++ {
+		if ok, _ := tb.Allow("a", now); !ok {
+			t.Fatalf("request %d of the burst is rejected", i)
+		}
+	}
+	ok, after := tb.Allow("a", now)
+	if ok || after != 100*time.Millisecond {
+		t.Errorf("over the burst: ok = %v, retry after %v, want false, 100ms", ok, after)
+	}
+	if ok, _ := tb.Allow("b", now); !ok {
+		t.Error("another key is limited too")
+	}
+	if ok, _ := tb.Allow("a", now.Add(after)); !ok {
+		t.Error("rejected after retry-after")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := NewSlidingWindow(4, time.Second)
+	start := time.Unix(100, 0)
+	for i := 0; i < 4; i++ {
+		if ok, _ := sw.Allow("a", start.Add(time.Duration(i)*100*time.Millisecond)); !ok {
+			t.Fatalf("request %d is rejected", i)
+		}
+	}
+	ok, after := sw.Allow("a", start.Add(500*time.Millisecond))
+	if ok || after != 500*time.Millisecond {
+		t.Errorf("over the limit: ok = %v, retry after %v, want false, 500ms", ok, after)
+	}
+	// A quarter into the next window, the previous 4 requests weigh 3, so one more is allowed.
+	next := start.Add(1250 * time.Millisecond)
+	if ok, _ := sw.Allow("a", next); !ok {
+		t.Error("rejected when the window has slid")
+	}
+	ok, after = sw.Allow("a", next)
+	if ok || after != 250*time.Millisecond {
+		t.Errorf("over the sliding limit: ok = %v, retry after %v, want false, 250ms", ok, after)
+	}
+}
+
+func TestBalancerRejects(t *testing.T) {
+	b := &Balancer{Out: io.Discard, Limiter: NewTokenBucket(0, 1)}
+	w := NewWorker(make(chan Request, 4))
+	comp := make(chan *Worker, 4)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+
+	res, errc := make(chan int, 1), make(chan error, 1)
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Tenant: "noisy"}
+	<-res
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Tenant: "noisy"}
+	var rejected *RejectedError
+	if err := <-errc; !errors.As(err, &rejected) || rejected.Tenant != "noisy" || rejected.Global {
+		t.Errorf("err = %v, want the tenant rejected", err)
+	}
+	r <- Request{Fn: func() int { return 2 }, Result: res, Err: errc, Tenant: "quiet"}
+	if got := <-res; got != 2 {
+		t.Errorf("result = %d, want 2 from another tenant", got)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	now := time.Unix(100, 0)
+	for name, l := range map[string]Limiter{
+		"TokenBucket":   NewTokenBucket(0, 1),
+		"SlidingWindow": NewSlidingWindow(1, time.Minute),
+	} {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("%s: the first request is rejected", name)
+		}
+		l.(Refunder).Refund("a", now)
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Errorf("%s: a refunded request is not allowed again", name)
+		}
+		if ok, _ := l.Allow("a", now); ok {
+			t.Errorf("%s: refund gave more than one request", name)
+		}
+	}
+}
+
+func TestBalancerRefundsTenant(t *testing.T) {
+	b := &Balancer{Out: io.Discard, Limiter: NewTokenBucket(0, 1), GlobalLimiter: NewTokenBucket(0, 1)}
+	w := NewWorker(make(chan Request, 4))
+	comp := make(chan *Worker, 4)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+
+	res, errc := make(chan int, 1), make(chan error, 1)
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Tenant: "a"}
+	<-res
+	// the global token is gone, so b is rejected globally and keeps its own token
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Tenant: "b"}
+	var rejected *RejectedError
+	if err := <-errc; !errors.As(err, &rejected) || !rejected.Global {
+		t.Fatalf("err = %v, want a global rejection", err)
+	}
+	if ok, _ := b.Limiter.Allow("b", time.Now()); !ok {
+		t.Error("the tenant has been charged for a globally rejected request")
+	}
+}
@@ -3,89 +3,418 @@ package loadbalancer
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"time"
+
+	"funmech.com/loadbalancer/pubsub"
+	"funmech.com/loadbalancer/quit"
 )
 
+// defaultTimeout is how long Balance waits for a request or a completion before giving up.
+const defaultTimeout = 10 * time.Second
+
 // Request represents a computation a load balancer support.
 // For now, make this a simple data structure, just for passing data
 type Request struct {
-	Fn     func() int // The operation to perform: anything takes no arguments and returns an int
-	Result chan int   // The channel to return the result.
+	Fn     func() int  // The operation to perform: anything takes no arguments and returns an int
+	Result chan int    // The channel to return the result.
+	Trace  SpanContext // The trace the request belongs to, optional.
+	Tenant string      // Who sent the request, the key of the per tenant rate limit, optional.
+	Zone   string      // The preferred zone of the Worker, optional, see Balancer.SpillThreshold.
+	// Task describes the request as data for remote Workers, which run it instead of Fn, see RemoteServer.
+	// A request made by Registry.Request has no Fn, local Workers run its Task with the Registry.
+	Task *Task
+	// Selector restricts the request to the Workers with matching capabilities, optional.
+	// When none of the Workers taking requests matches, it fails with a *NoMatchError.
+	Selector Selector
+	// Scatter, when set, sends the request to several Workers at once and gathers their results, see Scatter.
+	Scatter *Scatter
+	// Err receives the error when the request fails without a result, for example when it is rejected by a limiter.
+	// Without it, such a request is dropped silently.
+	Err chan error
+
+	// Spans started by the Balancer and ended by the Worker when there is a Tracer.
+	tracer Tracer
+	root   Span // the span of the whole request when it did not come with a trace context
+	queued Span // the span of waiting in the request channel of the Worker
+
+	registry *Registry // runs Task on local Workers when there is no Fn
+	log      *WAL      // where the request has been logged as seq, to be acknowledged when it completes
+	seq      uint64
+	siblings map[*Worker]bool // the Workers the other copies of a scattered request have been dispatched to
 }
 
 // Balancer: a load balancer manages a pool of Workers and a single channel to which Workers can report its completion.
 type Balancer struct {
-	pool Pool
+	// Out is where the balancer reports its progress. os.Stdout is used when it is nil,
+	// set it to io.Discard to keep the balancer quiet.
+	Out io.Writer
+	// Timeout is the maximal waiting time for a request or a completion before Balance returns.
+	// When it is zero, 10 seconds is used.
+	Timeout time.Duration
+	// StallTimeout is how long the balancer may be blocked on sending to a worker, or make no progress
+	// while requests are pending, before OnStall is called. When it is zero, 5 seconds is used.
+	StallTimeout time.Duration
+	// ShutdownTimeout is how long Balance waits, once its request channel is closed, for the Workers to complete
+	// the requests they hold and return from Work. All of them are told at once and waited for together, so it
+	// waits as long as the slowest one. The Workers which have not returned by then are named in the Err of the
+	// Shutdown event, a *quit.StragglerError. When it is zero, Balance returns without waiting.
+	ShutdownTimeout time.Duration
+	// Strategy picks the worker for each request, LeastPending is used when it is nil.
+	// It can be changed by SetStrategy while the balancer is running.
+	Strategy Strategy
+	// Limiter limits the rate of the requests of each Request.Tenant, and GlobalLimiter the rate of all requests.
+	// Requests over a limit are rejected with a *RejectedError. There is no limit when they are nil.
+	Limiter       Limiter
+	GlobalLimiter Limiter
+	// FairQueue, when set, queues requests per tenant inside the balancer and shares the workers between
+	// tenants by their weights when the workers are saturated, see FairQueue.
+	FairQueue *FairQueue
+	// SpillThreshold is the pending per weight from which a request for a zone may go to a less loaded Worker
+	// in another zone. When it is zero, requests stay in their zone while it has a Worker to take them.
+	SpillThreshold int
+	// Log, when set, keeps the accepted requests with a Task until they complete, so they can be recovered
+	// after a crash, see WAL. A request which cannot be logged is rejected with the error of the log.
+	Log *WAL
+	// Tracer receives the spans of requests, no span is recorded when it is nil.
+	Tracer Tracer
+	// Events, when set, gets every event of the balancer published under the name of its Kind, like
+	// "RequestCompleted", so many consumers can subscribe to the events they want, or to pubsub.All.
+	// The balancer waits for subscribers with the pubsub.Block policy, the other policies never hold it up.
+	// It is not closed when Balance returns, the last event is Shutdown.
+	Events *pubsub.Hub[Event]
+	// OnStall is called by a watchdog with a diagnostic snapshot when the balancer stalls, see Stall.
+	// The watchdog only runs when OnStall is set.
+	OnStall func(Stall)
+
+	// mu guards the states read by the watchdog, the balancer releases it while it is sending to a worker.
+	mu       sync.Mutex
+	pool     Pool
+	req      chan Request
+	complete chan *Worker
+	pending  int       // total count of pending requests of all workers
+	progress time.Time // last time a request was dispatched or completed
+	sending  *Worker   // the worker the balancer is sending a request to, it is not in pool meanwhile
+	since    time.Time // when the balancer started sending to the worker
+
+	omu       sync.Mutex // guards observers
+	observers []*Subscription
+
+	// The following are only used by the goroutine running Balance.
+	held        []Event // events which happened while mu was held, emitted by unlock
+	once        sync.Once
+	ctl         chan func()   // control functions to run in the balancer goroutine
+	done        chan struct{} // closed when Balance returns
+	workers     map[int]*Worker
+	lastID      int
+	strategy    Strategy
+	paused      bool
+	closing     bool // no more requests are coming, the fair queue is being drained
+	dispatched  int
+	completions int
+	rejected    int
+	zones       map[string]*ZoneInfo  // dispatch counts by the zones of requests and workers
+	selections  map[string]*selection // heaps of the Workers matching the Selectors used lately, by Selector.key
+	uses        uint64                // count of the uses of the selections, see selection.used
+	room        Pool                  // the candidates with room for a queued request, reused by roomy
+	members     quit.Group            // the Workers, told when the balancer stops
+	stopErr     error                 // the Workers which have not stopped in ShutdownTimeout
+}
+
+func (b *Balancer) out() io.Writer {
+	if b.Out == nil {
+		return os.Stdout
+	}
+	return b.Out
+}
+
+func (b *Balancer) timeout() time.Duration {
+	if b.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return b.Timeout
 }
 
 func (b *Balancer) print() {
+	out := b.out()
 	for i := 0; i < len(b.pool); i++ {
-		fmt.Printf("\tworker %d: pending = %d\n", i, b.pool[i].pending)
+		fmt.Fprintf(out, "\tworker %d: pending = %d\n", i, b.pool[i].pending)
 	}
-	fmt.Println()
+	fmt.Fprintln(out)
 }
 
 // Balance runs load balancing strategy and update the state of the worker pool using heap.
 // The balancer waits for new messages on the request and completion channels and act accordingly.
+// It also serves the control methods like Pause and AddWorker, which can be called from other goroutines.
+// Whoever adds a Worker starts its Work: the caller starts the Workers of wp, with complete as done, before
+// or after calling Balance, while the Balancer starts those it adds itself, like AddWorker.
 func (b *Balancer) Balance(wp Pool, req chan Request, complete chan *Worker) {
+	b.init()
+	defer close(b.done)
+	defer b.endObservers()
+	defer func() { b.emit(Event{Kind: Shutdown, Err: b.stopErr}) }()
+
+	// heap.Init only updates the index of the Workers it moves
+	for i, w := range wp {
+		w.index = i
+	}
 	heap.Init(&wp)
+	b.mu.Lock()
 	b.pool = wp
+	b.workers = make(map[int]*Worker, len(wp))
+	for _, w := range wp {
+		b.register(w)
+		b.hold(Event{Kind: WorkerAdded, Worker: w.id})
+	}
+	b.req, b.complete = req, complete
+	b.progress = time.Now()
+	b.unlock()
+	b.strategy = b.Strategy
+	if b.strategy == nil {
+		b.strategy = LeastPending{}
+	}
+
+	if b.OnStall != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go b.watch(stop)
+	}
 
-	var nN, nC int
 	for {
+		if b.closing && (b.FairQueue == nil || b.FairQueue.Len() == 0) {
+			fmt.Fprintln(b.out(), "Shut workers done by closing their request channels")
+			b.shutdown()
+			return
+		}
+		// Stop taking requests while paused or when there is no worker to send them to,
+		// unless they can wait in the fair queue.
+		in := req
+		if b.paused || b.closing || (b.pool.Len() == 0 && b.FairQueue == nil) {
+			in = nil
+		}
 		select {
-		case req, ok := <-req: // received a Request...
-			if ok {
-				nN++
-				fmt.Println("Balancer received request. Start to dispatch ...")
-				b.dispatch(req) // ...so send it to a Worker
-				b.print()
-			} else {
-				fmt.Println("Shut workers done by closing their request channels")
+		case req, ok := <-in: // received a Request...
+			if !ok {
+				if b.FairQueue != nil {
+					// dispatch the queued requests before shutting down
+					b.closing = true
+					continue
+				}
+				fmt.Fprintln(b.out(), "Shut workers done by closing their request channels")
 				b.shutdown()
 				return
 			}
+			b.accept(req)
 		case w := <-complete: // a worker has finished ...
-			nC++
-			fmt.Printf("Balancer received the signal of Done.\n\t So far dispatched job count: %d, completed job count: %d\n\n", nN, nC)
+			b.completions++
+			fmt.Fprintf(b.out(), "Balancer received the signal of Done.\n\t So far dispatched job count: %d, completed job count: %d\n\n", b.dispatched, b.completions)
 			b.completed(w) // ...so update its info
-		case <-time.After(10 * time.Second):
+			if b.FairQueue != nil {
+				b.drain() // ...and it may have room for a queued request
+			}
+		case f := <-b.ctl: // a control method wants to inspect or change the balancer
+			f()
+			if b.FairQueue != nil {
+				b.drain()
+			}
+		case <-time.After(b.timeout()):
 			// if anything takes long then the timer's duration, balancer will not wait
-			fmt.Println("Maximal waiting time for possible dispatch/completion has elapsed. If the timer was correctly set up, all jobs should have completed.")
+			fmt.Fprintln(b.out(), "Maximal waiting time for possible dispatch/completion has elapsed. If the timer was correctly set up, all jobs should have completed.")
+			return
+		}
+	}
+}
+
+// accept admits req and dispatches it, or queues it when there is a fair queue.
+func (b *Balancer) accept(req Request) {
+	if err := b.admit(req, time.Now()); err != nil {
+		b.reject(req, err)
+		return
+	}
+	p := b.candidates(req)
+	if len(p) == 0 && len(req.Selector) > 0 {
+		b.reject(req, &NoMatchError{Selector: req.Selector})
+		return
+	}
+	if b.Log != nil && req.Task != nil && req.log == nil {
+		seq, err := b.Log.append(*req.Task)
+		if err != nil {
+			b.reject(req, err)
+			return
+		}
+		req.log, req.seq = b.Log, seq
+	}
+	if req.Scatter != nil {
+		b.scatter(req, p)
+		return
+	}
+	if b.FairQueue != nil {
+		if !b.FairQueue.push(req, time.Now()) {
+			b.reject(req, ErrQueueFull)
 			return
 		}
+		b.dispatched++
+		b.emit(Event{Kind: RequestAccepted})
+		b.drain()
+		return
+	}
+	w := b.pick(req, p)
+	if w == nil {
+		b.reject(req, ErrUnavailable)
+		return
+	}
+	b.dispatched++
+	b.emit(Event{Kind: RequestAccepted})
+	fmt.Fprintln(b.out(), "Balancer received request. Start to dispatch ...")
+	b.dispatch(req, w) // ...so send it to the Worker
+	b.print()
+}
+
+func (b *Balancer) reject(req Request, err error) {
+	req.ack() // the requester has been answered
+	b.rejected++
+	b.fail(req, err)
+	b.emit(Event{Kind: RequestRejected, Err: err})
+}
+
+// fail reports err to the requester of req, without waiting for it.
+func (b *Balancer) fail(req Request, err error) {
+	if req.Err != nil {
+		go func() { req.Err <- err }()
+	}
+}
+
+// register gives w an ID if it does not have one yet and adds it to the workers the balancer knows.
+func (b *Balancer) register(w *Worker) {
+	if w.id == 0 {
+		b.lastID++
+		w.id = b.lastID
+	} else if w.id > b.lastID {
+		b.lastID = w.id
+	}
+	b.workers[w.id] = w
+	if w.member != nil { // it is nil for a Worker made without NewWorker
+		b.members.Add(w.member, fmt.Sprintf("worker %d", w.id))
 	}
 }
 
-// Send Request to worker
-func (b *Balancer) dispatch(req Request) {
-	// Grab the least loaded worker...
-	w := heap.Pop(&b.pool).(*Worker)
-	// ...send it the task.
-	w.request <- req
+// Send Request to worker w, picked by the strategy.
+func (b *Balancer) dispatch(req Request, w *Worker) {
+	span := b.trace(&req)
+	b.mu.Lock()
+	// Grab the worker...
+	if span != nil {
+		span.SetAttribute("worker.id", w.id)
+		span.SetAttribute("worker.pending", w.pending)
+		span.SetAttribute("worker.weight", w.getWeight())
+		span.SetAttribute("balancer.strategy", b.strategy.Name())
+		span.SetAttribute("balancer.workers", b.pool.Len())
+		req.queued = b.Tracer.Start(req.Trace, "queue")
+		req.queued.SetAttribute("worker.id", w.id)
+	}
+	heap.Remove(&b.pool, w.index)
+	b.count(req, w)
+	b.sending, b.since = w, time.Now()
+	b.mu.Unlock()
+	// ...send it the task. This blocks when the request channel of the worker is full.
+	sent := w.send(req)
+	if span != nil {
+		span.End()
+	}
+	b.mu.Lock()
+	defer b.unlock()
+	b.sending = nil
+	if !sent {
+		// It takes no more requests, so it stays out of the heap.
+		if req.tracer != nil {
+			req.queued.End()
+			if req.root != nil {
+				req.root.End()
+			}
+		}
+		req.ack()
+		b.rejected++
+		b.fail(req, ErrWorkerClosed)
+		b.hold(Event{Kind: RequestRejected, Worker: w.id, Err: ErrWorkerClosed})
+		return
+	}
 	// One more in its work queue.
 	w.pending++
+	b.pending++
+	b.progress = time.Now()
+	w.sent.Push(b.progress)
 	// Put it into its place on the heap.
 	heap.Push(&b.pool, w)
+	b.moved(w)
+	b.hold(Event{Kind: RequestDispatched, Worker: w.id})
 }
 
 // Job is complete; update heap
 func (b *Balancer) completed(w *Worker) {
+	b.mu.Lock()
+	defer b.unlock()
 	// One fewer in the queue.
 	w.pending--
-	// Remove it from heap.
-	heap.Remove(&b.pool, w.index)
-	// Put it into its place on the heap.
-	heap.Push(&b.pool, w)
-	// fmt.Printf("Cleanup done, and push the worker %d back to the pool for new requests.\n\n", w.index)
+	b.pending--
+	b.progress = time.Now()
+	b.hold(Event{Kind: RequestCompleted, Worker: w.id, Duration: b.progress.Sub(w.sent.Pop()), Err: w.outcome()})
+	if w.index >= 0 {
+		// Move it to its new place on the heap.
+		heap.Fix(&b.pool, w.index)
+		b.moved(w)
+		return
+	}
+	// It has been taken out of the heap, it leaves once it has nothing to do.
+	if w.health == Removing && w.pending == 0 {
+		b.retire(w)
+	}
+}
 
-	// this may be replaced by update / heap.Fix
+// retire closes the request channel of w, so its Work returns, and forgets about it. mu has to be held.
+func (b *Balancer) retire(w *Worker) {
+	if _, ok := b.workers[w.id]; !ok {
+		return // it has been ejected
+	}
+	w.close()
+	delete(b.workers, w.id)
+	b.hold(Event{Kind: WorkerRemoved, Worker: w.id})
 }
 
 func (b *Balancer) shutdown() {
+	b.mu.Lock()
+	if b.FairQueue != nil {
+		for _, req := range b.FairQueue.drainAll() {
+			b.fail(req, ErrStopped)
+		}
+	}
 	for b.pool.Len() > 0 {
-		w := heap.Pop(&b.pool).(*Worker)
-		close(w.request)
+		heap.Pop(&b.pool)
+	}
+	b.selections = nil
+	b.room = nil
+	// Workers out of the heap, like draining ones, have to be shut down too.
+	for _, w := range b.workers {
+		b.retire(w)
+	}
+	b.unlock()
+
+	// Tell all the Workers, even the ejected ones, nobody takes their completions any more,
+	// and wait for them to return.
+	ctx, cancel := context.WithTimeout(context.Background(), b.ShutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	err := b.members.Stop(ctx)
+	if b.ShutdownTimeout <= 0 {
+		return // it has not waited
+	}
+	if err != nil {
+		b.stopErr = err
+		fmt.Fprintf(b.out(), "Workers not stopped after %v: %v\n", b.ShutdownTimeout, err)
+		return
 	}
+	fmt.Fprintf(b.out(), "All workers stopped in %v\n", time.Since(start))
 }
@@ -0,0 +1,216 @@
+// Package mpmc provides a bounded lock-free queue for many producers and many consumers, an alternative
+// to a buffered channel.
+//
+// The queue is Dmitry Vyukov's bounded MPMC queue: an array of cells, each with a sequence number telling
+// whether it is free for the producer of a lap or full for its consumer. A producer or a consumer claims a position
+// with a compare-and-swap and never holds a lock, so a slow one never holds up the others when the queue
+// is neither full nor empty. Unlike a channel it cannot be used in a select.
+package mpmc
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// spins is how many times Push and Pop retry, yielding the processor in between, before they park.
+const spins = 16
+
+// cacheLine keeps the positions of producers and consumers on cache lines of their own,
+// so producers do not invalidate the line consumers read and the other way round.
+type cacheLine [64 - 8]byte
+
+type cell[T any] struct {
+	seq atomic.Uint64 // pos when free for the producer of pos, pos+1 when full for its consumer
+	val T
+}
+
+// Queue is a bounded FIFO queue safe for concurrent use by many producers and consumers. TryPush and TryPop
+// never wait, Push and Pop wait like a send and a receive on a buffered channel, and Close ends the queue
+// like closing a channel: Pop takes what is left, then reports it is closed.
+type Queue[T any] struct {
+	_     cacheLine
+	enq   atomic.Uint64 // next position to push to
+	_     cacheLine
+	deq   atomic.Uint64 // next position to pop from
+	_     cacheLine
+	mask  uint64
+	cells []cell[T]
+
+	closed atomic.Bool
+	done   chan struct{} // closed by Close, it wakes all the parked goroutines
+	// A goroutine which has spun in vain parks until it gets a token: producers hand one to consumers on
+	// notEmpty and consumers to producers on notFull when someone is parked.
+	notEmpty, notFull    chan struct{}
+	consumers, producers atomic.Int32 // parked goroutines
+}
+
+// New returns an empty Queue with room for size items, rounded up to a power of two of at least 2.
+func New[T any](size int) *Queue[T] {
+	n := 2
+	for n < size {
+		n <<= 1
+	}
+	q := &Queue[T]{
+		mask:     uint64(n - 1),
+		cells:    make([]cell[T], n),
+		done:     make(chan struct{}),
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+	for i := range q.cells {
+		q.cells[i].seq.Store(uint64(i))
+	}
+	return q
+}
+
+// Cap returns the count of items q has room for.
+func (q *Queue[T]) Cap() int { return len(q.cells) }
+
+// Len returns the count of items in q. It is a snapshot while other goroutines use q.
+func (q *Queue[T]) Len() int {
+	deq := q.deq.Load()
+	enq := q.enq.Load()
+	n := int(int64(enq - deq))
+	switch {
+	case n < 0: // deq moved on after it was read
+		return 0
+	case n > len(q.cells):
+		return len(q.cells)
+	}
+	return n
+}
+
+// TryPush adds v to the back of q, it returns false when q is full or closed.
+func (q *Queue[T]) TryPush(v T) bool {
+	if q.closed.Load() {
+		return false
+	}
+	pos := q.enq.Load()
+	for {
+		c := &q.cells[pos&q.mask]
+		switch dif := int64(c.seq.Load() - pos); {
+		case dif == 0:
+			if q.enq.CompareAndSwap(pos, pos+1) {
+				c.val = v
+				c.seq.Store(pos + 1)
+				q.wake(q.notEmpty, &q.consumers)
+				return true
+			}
+			pos = q.enq.Load()
+		case dif < 0:
+			return false // the cell still holds the item of the previous lap
+		default:
+			pos = q.enq.Load() // another producer has taken pos
+		}
+	}
+}
+
+// TryPop removes the item at the front of q and returns it, it returns false when q is empty.
+func (q *Queue[T]) TryPop() (T, bool) {
+	pos := q.deq.Load()
+	for {
+		c := &q.cells[pos&q.mask]
+		switch dif := int64(c.seq.Load() - (pos + 1)); {
+		case dif == 0:
+			if q.deq.CompareAndSwap(pos, pos+1) {
+				v := c.val
+				var zero T
+				c.val = zero // let it be collected
+				c.seq.Store(pos + q.mask + 1)
+				q.wake(q.notFull, &q.producers)
+				return v, true
+			}
+			pos = q.deq.Load()
+		case dif < 0:
+			var zero T
+			return zero, false // the cell has not been filled yet
+		default:
+			pos = q.deq.Load() // another consumer has taken pos
+		}
+	}
+}
+
+// Push adds v to the back of q, waiting while q is full. Unlike a send on a closed channel, it returns false
+// when q is closed, also while it waits.
+func (q *Queue[T]) Push(v T) bool {
+	parked := false
+	for i := 0; ; i++ {
+		if q.TryPush(v) {
+			if parked && q.Len() < len(q.cells) {
+				q.wake(q.notFull, &q.producers) // pass the token on, there is room for another one
+			}
+			return true
+		}
+		if q.closed.Load() {
+			return false
+		}
+		if i < spins {
+			runtime.Gosched()
+			continue
+		}
+		q.producers.Add(1)
+		if q.TryPush(v) { // a consumer may have made room before it saw the producer parked
+			q.producers.Add(-1)
+			return true
+		}
+		select {
+		case <-q.notFull:
+		case <-q.done:
+		}
+		q.producers.Add(-1)
+		parked = true
+	}
+}
+
+// Pop removes the item at the front of q and returns it, waiting while q is empty. Once q is closed and
+// empty, it returns false.
+func (q *Queue[T]) Pop() (T, bool) {
+	parked := false
+	for i := 0; ; i++ {
+		if v, ok := q.TryPop(); ok {
+			if parked && q.Len() > 0 {
+				q.wake(q.notEmpty, &q.consumers) // pass the token on, there is more for another one
+			}
+			return v, true
+		}
+		if q.closed.Load() && q.Len() == 0 {
+			var zero T
+			return zero, false
+		}
+		if i < spins {
+			runtime.Gosched()
+			continue
+		}
+		q.consumers.Add(1)
+		if v, ok := q.TryPop(); ok { // a producer may have pushed before it saw the consumer parked
+			q.consumers.Add(-1)
+			return v, true
+		}
+		select {
+		case <-q.notEmpty:
+		case <-q.done:
+		}
+		q.consumers.Add(-1)
+		parked = true
+	}
+}
+
+// Close tells the consumers nothing more is coming, the producers still pushing are refused.
+// Closing q again does nothing.
+func (q *Queue[T]) Close() {
+	if q.closed.CompareAndSwap(false, true) {
+		close(q.done)
+	}
+}
+
+// wake hands a token to the goroutines parked on c, if any. There is one token at most, so the goroutine
+// taking it passes it on when there is more to do after its move.
+func (q *Queue[T]) wake(c chan struct{}, parked *atomic.Int32) {
+	if parked.Load() == 0 {
+		return
+	}
+	select {
+	case c <- struct{}{}:
+	default: // a token is there already
+	}
+}
@@ -0,0 +1,198 @@
+package mpmc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func ExampleQueue() {
+	q := New[string](4)
+	go func() {
+		for _, s := range []string{"a", "b", "c", "d", "e", "f"} {
+			q.Push(s) // waits while the 4 cells are full
+		}
+		q.Close()
+	}()
+	for {
+		s, ok := q.Pop()
+		if !ok {
+			break
+		}
+		fmt.Print(s)
+	}
+	// Output: abcdef
+}
+
+func TestQueueFull(t *testing.T) {
+	q := New[int](3)
+	if c := q.Cap(); c != 4 {
+		t.Fatalf("Cap = %d, want 4", c)
+	}
+	for i := 0; i < 4; i++ {
+		if !q.TryPush(i) {
+			t.Fatalf("TryPush %d to a queue with room failed", i)
+		}
+	}
+	if q.TryPush(4) {
+		t.Fatal("TryPush to a full queue went through")
+	}
+	if n := q.Len(); n != 4 {
+		t.Errorf("Len = %d, want 4", n)
+	}
+	for want := 0; want < 4; want++ {
+		if v, ok := q.TryPop(); !ok || v != want {
+			t.Fatalf("TryPop = %d, %v, want %d, true", v, ok, want)
+		}
+	}
+	if _, ok := q.TryPop(); ok {
+		t.Error("TryPop of an empty queue went through")
+	}
+}
+
+// TestQueueContention checks that every item pushed by many producers is popped once by many consumers.
+func TestQueueContention(t *testing.T) {
+	const producers, consumers, n = 8, 8, 10000
+	q := New[int](16)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				q.Push(p*n + i)
+			}
+		}(p)
+	}
+	seen := make([][]int, consumers)
+	var cwg sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		cwg.Add(1)
+		go func(c int) {
+			defer cwg.Done()
+			last := make([]int, producers) // items of a producer come in order
+			for i := range last {
+				last[i] = -1
+			}
+			for {
+				v, ok := q.Pop()
+				if !ok {
+					return
+				}
+				if p := v / n; v <= last[p] {
+					t.Errorf("consumer %d got %d after %d", c, v, last[p])
+				} else {
+					last[p] = v
+				}
+				seen[c] = append(seen[c], v)
+			}
+		}(c)
+	}
+	wg.Wait()
+	q.Close()
+	cwg.Wait()
+
+	got := make([]bool, producers*n)
+	for _, vs := range seen {
+		for _, v := range vs {
+			if got[v] {
+				t.Fatalf("%d popped twice", v)
+			}
+			got[v] = true
+		}
+	}
+	for v, ok := range got {
+		if !ok {
+			t.Fatalf("%d never popped", v)
+		}
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q := New[int](2)
+	q.Close()
+	q.Close()
+	if _, ok := q.Pop(); ok {
+		t.Error("Pop of a closed empty queue went through")
+	}
+	if q.Push(1) || q.TryPush(1) {
+		t.Error("push to a closed queue went through")
+	}
+}
+
+func TestQueueCloseWhilePushing(t *testing.T) {
+	q := New[int](2)
+	q.Push(1)
+	q.Push(2)
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(3) }()
+	q.Close()
+	if <-pushed {
+		t.Error("push waiting on a full queue went through once it was closed")
+	}
+	for want := 1; want <= 2; want++ {
+		if v, ok := q.Pop(); !ok || v != want {
+			t.Errorf("Pop = %d, %v, want %d, true", v, ok, want)
+		}
+	}
+}
+
+// contend runs items through a transport with the given counts of producers and consumers.
+func contend(b *testing.B, producers, consumers int, push func(int), pop func() bool, close func()) {
+	b.ReportAllocs()
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		n := b.N / producers
+		if p < b.N%producers {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				push(i)
+			}
+		}(n)
+	}
+	var cwg sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		cwg.Add(1)
+		go func() {
+			defer cwg.Done()
+			for pop() {
+			}
+		}()
+	}
+	wg.Wait()
+	close()
+	cwg.Wait()
+}
+
+const size = 256
+
+func benchChan(b *testing.B, producers, consumers int) {
+	ch := make(chan int, size)
+	contend(b, producers, consumers,
+		func(v int) { ch <- v },
+		func() bool { _, ok := <-ch; return ok },
+		func() { close(ch) })
+}
+
+func benchQueue(b *testing.B, producers, consumers int) {
+	q := New[int](size)
+	contend(b, producers, consumers,
+		func(v int) { q.Push(v) },
+		func() bool { _, ok := q.Pop(); return ok },
+		q.Close)
+}
+
+func BenchmarkChan1x1(b *testing.B)    { benchChan(b, 1, 1) }
+func BenchmarkQueue1x1(b *testing.B)   { benchQueue(b, 1, 1) }
+func BenchmarkChan8x1(b *testing.B)    { benchChan(b, 8, 1) }
+func BenchmarkQueue8x1(b *testing.B)   { benchQueue(b, 8, 1) }
+func BenchmarkChan1x8(b *testing.B)    { benchChan(b, 1, 8) }
+func BenchmarkQueue1x8(b *testing.B)   { benchQueue(b, 1, 8) }
+func BenchmarkChan8x8(b *testing.B)    { benchChan(b, 8, 8) }
+func BenchmarkQueue8x8(b *testing.B)   { benchQueue(b, 8, 8) }
+func BenchmarkChan32x32(b *testing.B)  { benchChan(b, 32, 32) }
+func BenchmarkQueue32x32(b *testing.B) { benchQueue(b, 32, 32) }
@@ -0,0 +1,253 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"funmech.com/loadbalancer/internal/hist"
+)
+
+// Stage is a step of a Pipeline: a Balancer over a Pool of its own, running Fn on each result of the step before.
+type Stage struct {
+	Name string
+	Fn   func(int) int
+	// Pool holds the Workers of the stage. They are started by the Pipeline, so they must not be started by the caller.
+	Pool Pool
+	// Balancer balances the Pool, a quiet Balancer which never times out is used when it is nil.
+	// A Balancer returns after Timeout without requests, which ends the stage: give it a long Timeout.
+	Balancer *Balancer
+	// MaxInFlight is how many items may be in the stage at once, sent to its Workers or waiting for the next stage
+	// to take them. When the next stage is behind, the stage stops taking items, and so on up to the input.
+	// When it is zero, it is what the Workers can hold: one request in hand and a full request channel each.
+	MaxInFlight int
+}
+
+// Output is an item which has gone through a Pipeline, or has failed in Stage.
+type Output struct {
+	Seq     int // position of the item in the input, the outputs may come out of order
+	Value   int
+	Err     error
+	Stage   string        // name of the stage the item has failed in
+	Latency time.Duration // time from the input to the output
+}
+
+// StageMetrics describes a stage of a Pipeline.
+type StageMetrics struct {
+	Name        string        `json:"name"`
+	InFlight    int           `json:"in_flight"` // count of items in the stage
+	Completed   int           `json:"completed"`
+	Failed      int           `json:"failed"`
+	MeanLatency time.Duration `json:"mean_latency_ns"` // time spent in the stage, waiting for the next one included
+	P99Latency  time.Duration `json:"p99_latency_ns"`
+}
+
+// PipelineMetrics describes a Pipeline, from the input to the output.
+type PipelineMetrics struct {
+	Stages      []StageMetrics `json:"stages"`
+	Completed   int            `json:"completed"` // count of items out of the last stage
+	Failed      int            `json:"failed"`    // count of items failed in any stage
+	MeanLatency time.Duration  `json:"mean_latency_ns"`
+	P99Latency  time.Duration  `json:"p99_latency_ns"`
+}
+
+// Pipeline chains Balancers into stages, like decode, process and encode: each item of the input is sent as
+// a Request to the first stage, and the result of a stage becomes a Request for the next one.
+type Pipeline struct {
+	stages []Stage
+
+	mu    sync.Mutex // guards the metrics
+	stats []stageStats
+	total stageStats
+}
+
+type stageStats struct {
+	inFlight, completed, failed int
+	latency                     hist.Histogram
+}
+
+func (s *stageStats) done(d time.Duration, err error) {
+	s.inFlight--
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.completed++
+	s.latency.Record(d)
+}
+
+// item is an input on its way through the stages.
+type item struct {
+	seq   int
+	v     int
+	start time.Time
+	err   error
+	stage string
+}
+
+// NewPipeline returns a Pipeline of stages, in the order items go through them. It keeps a copy of the stages,
+// the defaults it fills in are not seen by the caller. It fails when a stage has no Fn, no Worker or a negative MaxInFlight.
+func NewPipeline(stages ...Stage) (*Pipeline, error) {
+	p := &Pipeline{stages: append([]Stage(nil), stages...), stats: make([]stageStats, len(stages))}
+	for i := range p.stages {
+		s := &p.stages[i]
+		if s.Fn == nil {
+			return nil, fmt.Errorf("stage %q has no Fn", s.Name)
+		}
+		if len(s.Pool) == 0 {
+			return nil, fmt.Errorf("stage %q has no worker", s.Name)
+		}
+		if s.MaxInFlight < 0 {
+			return nil, fmt.Errorf("stage %q: MaxInFlight cannot be negative, got %d", s.Name, s.MaxInFlight)
+		}
+		if s.Balancer == nil {
+			s.Balancer = &Balancer{Out: io.Discard, Timeout: 1<<63 - 1}
+		}
+		if s.MaxInFlight <= 0 {
+			for _, w := range s.Pool {
+				s.MaxInFlight += w.capacity() + 1
+			}
+		}
+	}
+	return p, nil
+}
+
+// Run starts the stages and sends them the items of in until in is closed or ctx is done. Every item taken
+// from in comes out of the returned channel, which is closed after the last one and must be drained.
+// When ctx is done, Run stops taking items and the items in the stages come out at once with the error
+// of ctx, the results of their Workers are dropped. Run is called once, the Balancers stop when it is over.
+func (p *Pipeline) Run(ctx context.Context, in <-chan int) <-chan Output {
+	first := make(chan item)
+	go func() {
+		defer close(first)
+		for seq := 0; ; seq++ {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				p.mu.Lock()
+				p.total.inFlight++
+				p.mu.Unlock()
+				first <- item{seq: seq, v: v, start: time.Now()}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	items := first
+	for i := range p.stages {
+		next := make(chan item)
+		go p.stage(ctx, i, items, next)
+		items = next
+	}
+	out := make(chan Output)
+	go func() {
+		defer close(out)
+		for it := range items {
+			o := Output{Seq: it.seq, Value: it.v, Err: it.err, Stage: it.stage, Latency: time.Since(it.start)}
+			p.mu.Lock()
+			p.total.done(o.Latency, o.Err)
+			p.mu.Unlock()
+			out <- o
+		}
+	}()
+	return out
+}
+
+// stage runs the items of in through stage i and hands them on to next, which it closes once in is closed
+// and its items have been handed on.
+func (p *Pipeline) stage(ctx context.Context, i int, in <-chan item, next chan<- item) {
+	s := &p.stages[i]
+	b := s.Balancer
+	b.init()
+	comp := make(chan *Worker, s.MaxInFlight)
+	for _, w := range s.Pool {
+		go w.Work(comp)
+	}
+	req := make(chan Request)
+	go b.Balance(s.Pool, req, comp)
+
+	slots := make(chan struct{}, s.MaxInFlight)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(req)
+		close(next)
+	}()
+	fail := func(it item, err error) {
+		it.err, it.stage = err, s.Name
+		next <- it
+	}
+	for it := range in {
+		if it.err != nil {
+			next <- it // it has failed before
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			fail(it, ctx.Err())
+			continue
+		}
+		res, errc := make(chan int, 1), make(chan error, 1)
+		v, fn := it.v, s.Fn
+		select {
+		case req <- Request{Fn: func() int { return fn(v) }, Result: res, Err: errc}:
+		case <-ctx.Done():
+			<-slots
+			fail(it, ctx.Err())
+			continue
+		case <-b.done:
+			<-slots
+			fail(it, ErrStopped)
+			continue
+		}
+		p.mu.Lock()
+		p.stats[i].inFlight++
+		p.mu.Unlock()
+		wg.Add(1)
+		go func(it item, start time.Time) {
+			defer wg.Done()
+			select {
+			case it.v = <-res:
+			case err := <-errc:
+				it.err, it.stage = err, s.Name
+			case <-ctx.Done():
+				it.err, it.stage = ctx.Err(), s.Name
+			}
+			next <- it // it holds its slot until the next stage takes it
+			p.mu.Lock()
+			p.stats[i].done(time.Since(start), it.err)
+			p.mu.Unlock()
+			<-slots
+		}(it, time.Now())
+	}
+}
+
+// Metrics returns the counts and latencies of the stages and of the whole Pipeline so far.
+func (p *Pipeline) Metrics() PipelineMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := PipelineMetrics{
+		Stages:      make([]StageMetrics, len(p.stages)),
+		Completed:   p.total.completed,
+		Failed:      p.total.failed,
+		MeanLatency: p.total.latency.Mean(),
+		P99Latency:  p.total.latency.Quantile(0.99),
+	}
+	for i, s := range p.stages {
+		st := &p.stats[i]
+		m.Stages[i] = StageMetrics{
+			Name:        s.Name,
+			InFlight:    st.inFlight,
+			Completed:   st.completed,
+			Failed:      st.failed,
+			MeanLatency: st.latency.Mean(),
+			P99Latency:  st.latency.Quantile(0.99),
+		}
+	}
+	return m
+}
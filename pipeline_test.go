@@ -0,0 +1,167 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// workers returns a Pool of n Workers with request channels of size.
+func workers(n, size int) Pool {
+	wp := make(Pool, n)
+	for i := range wp {
+		w := NewWorker(make(chan Request, size))
+		wp[i] = &w
+	}
+	return wp
+}
+
+func ExamplePipeline() {
+	p, err := NewPipeline(
+		Stage{Name: "decode", Fn: func(v int) int { return v + 1 }, Pool: workers(2, 1)},
+		Stage{Name: "process", Fn: func(v int) int { return v * 10 }, Pool: workers(4, 1)},
+		Stage{Name: "encode", Fn: func(v int) int { return v - 1 }, Pool: workers(2, 1)},
+	)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	in := make(chan int)
+	go func() {
+		for i := 0; i < 3; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+	results := make([]int, 3)
+	for o := range p.Run(context.Background(), in) {
+		results[o.Seq] = o.Value
+	}
+	fmt.Println(results, p.Metrics().Completed)
+	// Output: [9 19 29] 3
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	p, err := NewPipeline(
+		Stage{Name: "fast", Fn: func(v int) int { return v }, Pool: workers(2, 2), MaxInFlight: 2},
+		Stage{Name: "slow", Fn: func(v int) int { <-release; return v }, Pool: workers(1, 0), MaxInFlight: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var taken atomic.Int64
+	in := make(chan int)
+	go func() {
+		for i := 0; i < 100; i++ {
+			in <- i
+			taken.Add(1)
+		}
+		close(in)
+	}()
+	out := p.Run(context.Background(), in)
+	time.Sleep(50 * time.Millisecond)
+	// 1 in the slow stage, 1 waiting for a slot of it, 2 in the fast stage, 1 waiting for a slot of it
+	// and 1 in the reader of the input
+	if n := taken.Load(); n > 6 {
+		t.Errorf("%d items taken while the last stage is stuck, want the input held back", n)
+	}
+	m := p.Metrics()
+	if m.Stages[0].InFlight != 2 || m.Stages[1].InFlight != 1 {
+		t.Errorf("in flight %d and %d, want 2 and 1", m.Stages[0].InFlight, m.Stages[1].InFlight)
+	}
+	close(release)
+	var seqs []int
+	for o := range out {
+		if o.Err != nil {
+			t.Fatal(o.Err)
+		}
+		seqs = append(seqs, o.Seq)
+	}
+	sort.Ints(seqs)
+	for i, s := range seqs {
+		if s != i {
+			t.Fatalf("outputs %v, want 0 to 99 once", seqs)
+		}
+	}
+	if m := p.Metrics(); m.Completed != 100 || m.Stages[1].Completed != 100 || m.Failed != 0 {
+		t.Errorf("metrics = %+v, want 100 completed", m)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	p, err := NewPipeline(
+		Stage{Name: "first", Fn: func(v int) int { return v }, Pool: workers(1, 1)},
+		Stage{Name: "stuck", Fn: func(v int) int { <-block; return v }, Pool: workers(1, 1)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan int)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case in <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out := p.Run(ctx, in)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	n := 0
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case o, ok := <-out:
+			if !ok {
+				if n == 0 {
+					t.Error("no item came out")
+				}
+				if m := p.Metrics(); m.Failed != n {
+					t.Errorf("failed = %d, want %d", m.Failed, n)
+				}
+				return
+			}
+			n++
+			if !errors.Is(o.Err, context.Canceled) {
+				t.Errorf("item %d: err = %v in %q, want it canceled", o.Seq, o.Err, o.Stage)
+			}
+		case <-timeout:
+			t.Fatal("the output is not closed after the cancellation")
+		}
+	}
+}
+
+func TestNewPipeline(t *testing.T) {
+	stages := []Stage{{Name: "only", Fn: func(v int) int { return v }, Pool: workers(2, 3)}}
+	p, err := NewPipeline(stages...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages[0].Balancer != nil || stages[0].MaxInFlight != 0 {
+		t.Errorf("stage = %+v, want the stage of the caller unchanged", stages[0])
+	}
+	if n := p.stages[0].MaxInFlight; n != 8 {
+		t.Errorf("MaxInFlight = %d, want 8 from the Workers", n)
+	}
+
+	for _, s := range []Stage{
+		{Name: "empty", Fn: func(v int) int { return v }},
+		{Name: "negative", Fn: func(v int) int { return v }, Pool: workers(1, 1), MaxInFlight: -1},
+		{Name: "no fn", Pool: workers(1, 1)},
+	} {
+		if _, err := NewPipeline(s); err == nil {
+			t.Errorf("stage %q: no error", s.Name)
+		}
+	}
+}
@@ -1,38 +1,266 @@
 package loadbalancer
 
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"funmech.com/loadbalancer/mpmc"
+	"funmech.com/loadbalancer/queue"
+	"funmech.com/loadbalancer/quit"
+)
+
 type Pool []*Worker
 
 type Worker struct {
-	request chan Request // work to do (buffered channel)
-	pending int          // count of pending tasks, it decides the order of Worker in they queue
+	request chan Request         // work to do (buffered channel)
+	inbox   *mpmc.Queue[Request] // work to do instead of request, when the Worker is made by NewQueueWorker
+	pending int                  // count of pending tasks, it decides the order of Worker in they queue
 	// The index is needed by update and is maintained by the heap.Interface methods.
-	index int // index in the heap
+	index  int               // index in the heap
+	id     int               // identity given by the Balancer, it does not change
+	weight int               // relative capacity, a Worker with weight 2 takes twice the pending of a Worker with weight 1
+	health Health            // only a Healthy Worker is in the heap
+	labels Labels            // where the Worker runs
+	caps   map[string]string // what the Worker can do, see Request.Selector
+	group  *group            // the Workers the Worker stands for, when it is made by NewGroup
+	remote *remote           // the agent running the requests, when the Worker has joined through a RemoteServer
+	member *quit.Member      // acknowledges the stop of the Balancer when Work returns
+	// sent holds the dispatch times of the pending requests, the oldest first.
+	// A Worker serves its requests in order, so the first one is the next to complete.
+	sent queue.Ring[time.Time]
+	// outcomes holds the error, nil on success, of each request the Worker has reported done and the Balancer
+	// has not yet taken from done, in the order of the reports. The Worker pushes and the Balancer pops, under omu.
+	omu      sync.Mutex
+	outcomes queue.Ring[error]
+}
+
+// Health tells whether a Worker takes new requests.
+type Health int
+
+const (
+	Healthy  Health = iota // takes new requests
+	Draining               // takes no new requests but stays with the Balancer
+	Removing               // takes no new requests and leaves the Balancer once its pending requests have completed
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Draining:
+		return "draining"
+	case Removing:
+		return "removing"
+	}
+	return fmt.Sprintf("Health(%d)", int(h))
+}
+
+func (h Health) MarshalText() ([]byte, error) { return []byte(h.String()), nil }
+
+func (h *Health) UnmarshalText(text []byte) error {
+	for _, v := range []Health{Healthy, Draining, Removing} {
+		if v.String() == string(text) {
+			*h = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health %q", text)
 }
 
 func NewWorker(req chan Request) Worker {
 	return Worker{
 		request: req,
+		member:  quit.NewMember(),
+	}
+}
+
+// NewQueueWorker returns a Worker whose work to do is in a lock-free queue of size rounded up to a power of two,
+// instead of a channel. The balancer hands requests over without the runtime lock of a channel, which
+// costs less when many Workers complete and are dispatched to at once, see package mpmc.
+func NewQueueWorker(size int) Worker {
+	return Worker{
+		inbox:  mpmc.New[Request](size),
+		member: quit.NewMember(),
 	}
 }
 
+// send hands req over to w, waiting while its request channel or queue is full.
+// It returns false when the queue of w has been closed, a request channel must not be.
+func (w *Worker) send(req Request) bool {
+	if w.inbox != nil {
+		return w.inbox.Push(req)
+	}
+	w.request <- req
+	return true
+}
+
+// close tells w no more requests are coming, so its Work returns once it has done those it has.
+func (w *Worker) close() {
+	if w.inbox != nil {
+		w.inbox.Close()
+		return
+	}
+	close(w.request)
+}
+
+// queued returns the count of requests waiting for w.
+func (w *Worker) queued() int {
+	if w.inbox != nil {
+		return w.inbox.Len()
+	}
+	return len(w.request)
+}
+
+// capacity returns the count of requests which can wait for w.
+func (w *Worker) capacity() int {
+	if w.inbox != nil {
+		return w.inbox.Cap()
+	}
+	return cap(w.request)
+}
+
+// SetLabels tells where w runs, it has to be set before w joins a Balancer.
+func (w *Worker) SetLabels(l Labels) { w.labels = l }
+
+// Labels returns where w runs.
+func (w *Worker) Labels() Labels { return w.labels }
+
+// SetCapabilities tells what w can do, like {"gpu": "true"}. It has to be set before w joins a Balancer.
+// w keeps a copy of caps, so changing caps afterwards does not change w.
+func (w *Worker) SetCapabilities(caps map[string]string) { w.caps = copyCaps(caps) }
+
+// Capabilities returns a copy of what w can do.
+func (w *Worker) Capabilities() map[string]string { return copyCaps(w.caps) }
+
+func copyCaps(caps map[string]string) map[string]string {
+	if caps == nil {
+		return nil
+	}
+	c := make(map[string]string, len(caps))
+	for k, v := range caps {
+		c[k] = v
+	}
+	return c
+}
+
+// ID returns the identity the Balancer has given to w, it is 0 before w joins a Balancer.
+func (w *Worker) ID() int { return w.id }
+
+// SetWeight sets the relative capacity of w, it is 1 by default.
+// The Balancer keeps pending/weight even across Workers, so it has to be set before w joins a Balancer.
+func (w *Worker) SetWeight(weight int) { w.weight = weight }
+
+func (w *Worker) getWeight() int {
+	if w.weight <= 0 {
+		return 1
+	}
+	return w.weight
+}
+
+// Work runs the requests the Balancer sends to w and reports each on done once it has completed, until
+// the Balancer closes its request channel. Once the Balancer has stopped, it no longer waits for the Balancer
+// to take a report from done, and it acknowledges the stop when it returns.
 func (w *Worker) Work(done chan *Worker) {
+	defer w.member.Ack()
+	switch {
+	case w.group != nil:
+		w.group.serve(w, done)
+		return
+	case w.remote != nil:
+		w.remote.serve(w, done)
+		return
+	}
+	if w.inbox != nil {
+		for {
+			req, ok := w.inbox.Pop()
+			if !ok {
+				return
+			}
+			w.handle(req, done)
+		}
+	}
 	for req := range w.request {
 		// fmt.Println("Getting a request from pool for requests")
 		// req := <-w.request // get a Request from the pool in balancer
-		// fmt.Println("The worker with least load has been received. Run the request and pass on the result to request.")
-		// send result to requester by the channel defined in Request
-		req.Result <- req.Fn() // call fn and send result
-		// fmt.Println("Worker has sent result to Request's channel. Next, tell balancer it is done.")
-		done <- w // we've finished this request, notify the pool in balancer
-		// fmt.Println("Balancer has been notified from a worker.")
+		w.handle(req, done)
+	}
+}
+
+// handle runs req, answers its requester and tells the balancer w is done with it.
+func (w *Worker) handle(req Request, done chan *Worker) {
+	// fmt.Println("The worker with least load has been received. Run the request and pass on the result to request.")
+	// send result to requester by the channel defined in Request
+	v, err := w.run(req) // call fn and send result
+	if err != nil {
+		if req.Err != nil {
+			go func(errc chan error) { errc <- err }(req.Err)
+		}
+	} else {
+		req.Result <- v
 	}
+	req.ack()
+	// fmt.Println("Worker has sent result to Request's channel. Next, tell balancer it is done.")
+	w.finished(done, err) // we've finished this request, notify the pool in balancer
+	// fmt.Println("Balancer has been notified from a worker.")
+}
+
+// finished reports on done that w has completed a request with err, nil when it has succeeded,
+// unless the Balancer has stopped and does not listen.
+func (w *Worker) finished(done chan *Worker, err error) {
+	w.omu.Lock()
+	w.outcomes.Push(err)
+	w.omu.Unlock()
+	select {
+	case done <- w:
+	case <-w.member.Stopping():
+	}
+}
+
+// outcome returns the error of the oldest request w has reported done, for the Balancer taking the report.
+func (w *Worker) outcome() error {
+	w.omu.Lock()
+	defer w.omu.Unlock()
+	if w.outcomes.Len() == 0 {
+		return nil // reported on done by someone else than Work
+	}
+	return w.outcomes.Pop()
+}
+
+// run calls req.Fn, or runs its Task with its Registry, and ends the spans the Balancer started for req.
+func (w *Worker) run(req Request) (int, error) {
+	if req.tracer == nil {
+		return execute(req)
+	}
+	req.queued.End()
+	span := req.tracer.Start(req.Trace, "execute")
+	span.SetAttribute("worker.id", w.id)
+	v, err := execute(req)
+	span.End()
+	if req.root != nil {
+		req.root.End()
+	}
+	return v, err
+}
+
+func execute(req Request) (int, error) {
+	switch {
+	case req.Fn != nil:
+		return req.Fn(), nil
+	case req.Task != nil && req.registry != nil:
+		return req.registry.Run(*req.Task)
+	}
+	return 0, ErrNoFn
 }
 
 func (p Pool) Len() int { return len(p) }
 
-func (p Pool) Less(i, j int) bool {
-	// A Worker with a smaller pending is in the front
-	return p[i].pending < p[j].pending
+func (p Pool) Less(i, j int) bool { return lighter(p[i], p[j]) }
+
+// lighter reports whether a is less loaded than b. A Worker with a smaller pending is in the front
+// of the heap, relative to its weight: pending(a)/weight(a) < pending(b)/weight(b) without the division.
+func lighter(a, b *Worker) bool {
+	return a.pending*b.getWeight() < b.pending*a.getWeight()
 }
 
 func (p Pool) Swap(i, j int) {
@@ -0,0 +1,160 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"funmech.com/loadbalancer/quit"
+)
+
+func TestQueueWorker(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	ws := []Worker{NewQueueWorker(4), NewQueueWorker(4)}
+	comp := make(chan *Worker, 16)
+	stopped := make(chan struct{}, len(ws))
+	for i := range ws {
+		go func(w *Worker) {
+			w.Work(comp)
+			stopped <- struct{}{}
+		}(&ws[i])
+	}
+	r := make(chan Request)
+	go b.Balance(Pool{&ws[0], &ws[1]}, r, comp)
+	defer close(r)
+
+	const n = 100
+	res := make(chan int, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			r <- Request{Fn: func() int { time.Sleep(time.Millisecond); return 1 }, Result: res}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		<-res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := b.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range s.Workers {
+		if w.QueueCap != 4 {
+			t.Errorf("worker %d: queue capacity %d, want 4", w.ID, w.QueueCap)
+		}
+	}
+
+	// A removed Worker finds its queue closed and returns.
+	if err := b.RemoveWorker(ctx, ws[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the Work of a removed queue Worker has not returned")
+	}
+}
+
+// TestWorkAfterShutdown checks that Work returns once the Balancer has stopped, although nobody takes
+// its completions any more.
+func TestDispatchToClosedQueue(t *testing.T) {
+	b := &Balancer{Out: io.Discard, ShutdownTimeout: 10 * time.Millisecond}
+	// Nobody works, so the queue fills up and the balancer waits in dispatch until the queue is closed.
+	w := NewQueueWorker(2)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, make(chan *Worker))
+	defer close(r)
+
+	errc := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		r <- Request{Fn: func() int { return 1 }, Result: make(chan int, 1), Err: errc}
+	}
+	for w.inbox.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	w.inbox.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrWorkerClosed) {
+			t.Errorf("err = %v, want ErrWorkerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request sent to a closed queue has not failed")
+	}
+}
+
+func TestWorkAfterShutdown(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	w := NewWorker(make(chan Request, 2))
+	comp := make(chan *Worker) // nobody reads it after Balance has returned
+	worked := make(chan struct{})
+	go func() {
+		w.Work(comp)
+		close(worked)
+	}()
+	r := make(chan Request)
+	balanced := make(chan struct{})
+	go func() {
+		b.Balance(Pool{&w}, r, comp)
+		close(balanced)
+	}()
+
+	release := make(chan struct{})
+	res := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		r <- Request{Fn: func() int { <-release; return 1 }, Result: res}
+	}
+	close(r)
+	<-balanced
+	close(release)
+	for i := 0; i < 2; i++ {
+		<-res // the requests in its channel still complete
+	}
+	select {
+	case <-worked:
+	case <-time.After(time.Second):
+		t.Fatal("Work has not returned after the Balancer stopped")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b := &Balancer{Out: io.Discard, ShutdownTimeout: 100 * time.Millisecond}
+	var stopped error
+	sub := b.Observe(ObserverFunc(func(e Event) {
+		if e.Kind == Shutdown {
+			stopped = e.Err
+		}
+	}), 16)
+	wp := make(Pool, 3)
+	comp := make(chan *Worker, 8)
+	for i := range wp {
+		w := NewWorker(make(chan Request, 1))
+		wp[i] = &w
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+
+	// One Worker is stuck in its request, the others have nothing to do.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	r <- Request{Fn: func() int { close(started); <-release; return 1 }, Result: make(chan int, 1)}
+	<-started
+	close(r)
+
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Balance has not returned after its ShutdownTimeout")
+	}
+	var se *quit.StragglerError
+	if !errors.As(stopped, &se) || !reflect.DeepEqual(se.Stragglers, []string{"worker 1"}) {
+		t.Errorf("Shutdown error = %v, want worker 1 not stopped", stopped)
+	}
+}
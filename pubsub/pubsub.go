@@ -0,0 +1,189 @@
+// Package pubsub is an in-process publish and subscribe hub, grown from the chat channel of
+// cmd/comms/subordinates.go: instead of everyone sending into one channel read by one controller,
+// publishers send to topics and every subscriber of a topic gets its own buffered channel.
+//
+// A subscriber which does not keep up is handled by its Policy: its messages are dropped, the publisher
+// waits for it, or it is disconnected.
+package pubsub
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// All is the topic whose subscribers get the messages of every topic.
+const All = "*"
+
+// Policy tells what Publish does when the buffer of a subscriber is full.
+type Policy int
+
+const (
+	Drop       Policy = iota // the message is dropped for the subscriber and counted, see Subscriber.Dropped
+	Block                    // the publisher waits until the subscriber has room or unsubscribes
+	Disconnect               // the subscriber is unsubscribed, its channel is closed and Disconnected returns true
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Drop:
+		return "drop"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Hub delivers the messages published to a topic to the subscribers of the topic. The zero value is an empty Hub.
+// It is safe for concurrent use.
+type Hub[T any] struct {
+	mu     sync.RWMutex
+	topics map[string][]*Subscriber[T]
+	closed bool
+}
+
+// Subscriber receives the messages of a topic on C, in the order they have been published.
+type Subscriber[T any] struct {
+	topic  string
+	policy Policy
+	hub    *Hub[T]
+	ch     chan T
+
+	mu           sync.Mutex    // held while delivering, so messages are not reordered and C is not closed meanwhile
+	closed       bool          // C is closed
+	gone         chan struct{} // closed when unsubscribing, it releases a publisher waiting on a Block subscriber
+	once         sync.Once
+	dropped      atomic.Int64
+	disconnected atomic.Bool
+}
+
+// Subscribe returns a Subscriber of topic, or of all topics when topic is All, with a buffer of buffer messages.
+// When the Hub is closed, its channel is closed already.
+func (h *Hub[T]) Subscribe(topic string, buffer int, p Policy) *Subscriber[T] {
+	s := &Subscriber[T]{topic: topic, policy: p, hub: h, ch: make(chan T, buffer), gone: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		s.end()
+		return s
+	}
+	if h.topics == nil {
+		h.topics = make(map[string][]*Subscriber[T])
+	}
+	h.topics[topic] = append(h.topics[topic], s)
+	return s
+}
+
+// Publish sends v to the subscribers of topic and of All. It waits only for the subscribers with the Block policy.
+func (h *Hub[T]) Publish(topic string, v T) {
+	h.mu.RLock()
+	subs := make([]*Subscriber[T], 0, len(h.topics[topic])+len(h.topics[All]))
+	subs = append(subs, h.topics[topic]...)
+	if topic != All {
+		subs = append(subs, h.topics[All]...)
+	}
+	h.mu.RUnlock()
+	for _, s := range subs {
+		s.deliver(v)
+	}
+}
+
+// Subscribers returns the count of subscribers of topic, not counting those of All.
+func (h *Hub[T]) Subscribers(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.topics[topic])
+}
+
+// Close unsubscribes everyone, which closes their channels. Publish does nothing afterwards.
+func (h *Hub[T]) Close() {
+	h.mu.Lock()
+	var subs []*Subscriber[T]
+	for _, ss := range h.topics {
+		subs = append(subs, ss...)
+	}
+	h.topics, h.closed = nil, true
+	h.mu.Unlock()
+	for _, s := range subs {
+		s.end()
+	}
+}
+
+func (h *Hub[T]) remove(s *Subscriber[T]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.topics[s.topic]
+	for i, o := range subs {
+		if o == s {
+			subs = append(subs[:i:i], subs[i+1:]...) // a copy, Publish may be iterating over the old one
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(h.topics, s.topic)
+	} else {
+		h.topics[s.topic] = subs
+	}
+}
+
+// C returns the channel of the messages, it is closed once s is unsubscribed.
+func (s *Subscriber[T]) C() <-chan T { return s.ch }
+
+// Topic returns the topic s has subscribed to.
+func (s *Subscriber[T]) Topic() string { return s.topic }
+
+// Dropped returns the count of messages dropped because the buffer of s was full, with the Drop policy.
+func (s *Subscriber[T]) Dropped() int64 { return s.dropped.Load() }
+
+// Disconnected reports whether s has been unsubscribed because its buffer was full, with the Disconnect policy.
+func (s *Subscriber[T]) Disconnected() bool { return s.disconnected.Load() }
+
+// Unsubscribe stops the delivery to s and closes its channel. The messages in its buffer can still be received.
+func (s *Subscriber[T]) Unsubscribe() {
+	s.hub.remove(s)
+	s.end()
+}
+
+// end closes the channel of s, after releasing a publisher waiting for room in it.
+func (s *Subscriber[T]) end() {
+	s.once.Do(func() {
+		close(s.gone)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
+
+func (s *Subscriber[T]) deliver(v T) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	switch s.policy {
+	case Block:
+		select {
+		case s.ch <- v:
+		case <-s.gone:
+		}
+	case Disconnect:
+		select {
+		case s.ch <- v:
+		default:
+			s.disconnected.Store(true)
+			s.mu.Unlock()
+			s.Unsubscribe()
+			return
+		}
+	default:
+		select {
+		case s.ch <- v:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func ExampleHub() {
+	var h Hub[string]
+	chat := h.Subscribe("chat", 10, Drop)
+	everything := h.Subscribe(All, 10, Drop)
+	h.Publish("chat", "hello")
+	h.Publish("news", "rain")
+	h.Close()
+	for m := range chat.C() {
+		fmt.Println("chat:", m)
+	}
+	for m := range everything.C() {
+		fmt.Println("all:", m)
+	}
+	// Output:
+	// chat: hello
+	// all: hello
+	// all: rain
+}
+
+func TestDrop(t *testing.T) {
+	var h Hub[int]
+	s := h.Subscribe("t", 2, Drop)
+	for i := 0; i < 5; i++ {
+		h.Publish("t", i)
+	}
+	if d := s.Dropped(); d != 3 {
+		t.Errorf("Dropped = %d, want 3", d)
+	}
+	s.Unsubscribe()
+	var got []int
+	for v := range s.C() {
+		got = append(got, v)
+	}
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("received %v, want [0 1]", got)
+	}
+	h.Publish("t", 5) // nobody listens
+	if n := h.Subscribers("t"); n != 0 {
+		t.Errorf("Subscribers = %d after Unsubscribe, want 0", n)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	var h Hub[int]
+	s := h.Subscribe("t", 1, Block)
+	h.Publish("t", 0)
+	published := make(chan struct{})
+	go func() {
+		h.Publish("t", 1) // waits for room
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("Publish to a full Block subscriber did not wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if v := <-s.C(); v != 0 {
+		t.Errorf("received %d, want 0", v)
+	}
+	<-published
+	if v := <-s.C(); v != 1 {
+		t.Errorf("received %d, want 1", v)
+	}
+
+	// Unsubscribing releases a waiting publisher.
+	h.Publish("t", 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Unsubscribe()
+	}()
+	h.Publish("t", 3)
+}
+
+func TestDisconnect(t *testing.T) {
+	var h Hub[int]
+	slow := h.Subscribe("t", 1, Disconnect)
+	fast := h.Subscribe("t", 10, Disconnect)
+	for i := 0; i < 3; i++ {
+		h.Publish("t", i)
+	}
+	if !slow.Disconnected() || fast.Disconnected() {
+		t.Fatalf("disconnected slow %v, fast %v, want only slow", slow.Disconnected(), fast.Disconnected())
+	}
+	n := 0
+	for range slow.C() {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("slow received %d messages, want the one buffered", n)
+	}
+	if c := h.Subscribers("t"); c != 1 {
+		t.Errorf("Subscribers = %d, want 1", c)
+	}
+}
@@ -0,0 +1,100 @@
+// Package queue provides a FIFO queue in a ring buffer.
+//
+// A queue kept as a slice with q = q[1:] and append keeps the head of its array alive and allocates a new
+// array whenever append runs out of the room left behind the head, so under steady load it reallocates
+// over and over. Ring reuses its array: it only allocates when it grows beyond its capacity.
+package queue
+
+// minCap is the capacity a Ring starts with.
+const minCap = 8
+
+// Ring is a FIFO queue in a circular buffer. It doubles its capacity when it is full and halves it when it is
+// less than a quarter full, so a burst does not hold memory forever. The zero value is an empty queue.
+// It is not safe for concurrent use.
+type Ring[T any] struct {
+	buf   []T
+	head  int // index of the first item
+	n     int // count of items
+	floor int // capacity it never shrinks below
+}
+
+// New returns an empty Ring with room for capacity items, which it keeps when it shrinks.
+// A queue with a known bound, like the buffer of a bounded channel, never allocates again.
+func New[T any](capacity int) *Ring[T] {
+	r := &Ring[T]{floor: capacity}
+	if capacity > 0 {
+		r.buf = make([]T, capacity)
+	}
+	return r
+}
+
+// Len returns the count of items in r.
+func (r *Ring[T]) Len() int { return r.n }
+
+// Cap returns the count of items r can hold before it grows.
+func (r *Ring[T]) Cap() int { return len(r.buf) }
+
+// Push adds v to the back of r.
+func (r *Ring[T]) Push(v T) {
+	if r.n == len(r.buf) {
+		r.resize(2 * len(r.buf))
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = v
+	r.n++
+}
+
+// Pop removes the item at the front of r and returns it. It panics when r is empty.
+func (r *Ring[T]) Pop() T {
+	if r.n == 0 {
+		panic("queue: Pop of an empty Ring")
+	}
+	v := r.buf[r.head]
+	var zero T
+	r.buf[r.head] = zero // let it be collected
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	if len(r.buf) > minCap && len(r.buf) > r.floor && r.n < len(r.buf)/4 {
+		r.resize(len(r.buf) / 2)
+	}
+	return v
+}
+
+// Peek returns the item at the front of r. It panics when r is empty.
+func (r *Ring[T]) Peek() T {
+	if r.n == 0 {
+		panic("queue: Peek of an empty Ring")
+	}
+	return r.buf[r.head]
+}
+
+// At returns the i-th item from the front of r, At(0) is Peek. It panics when i is out of range.
+func (r *Ring[T]) At(i int) T {
+	if i < 0 || i >= r.n {
+		panic("queue: index out of range")
+	}
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+// Clear removes all items from r and lets its array go, but the capacity given to New.
+func (r *Ring[T]) Clear() { *r = *New[T](r.floor) }
+
+func (r *Ring[T]) resize(size int) {
+	if size < minCap {
+		size = minCap
+	}
+	if size < r.floor {
+		size = r.floor
+	}
+	buf := make([]T, size)
+	// copy the items in order, they may wrap around the end of the old array
+	if r.n > 0 {
+		end := r.head + r.n
+		if end <= len(r.buf) {
+			copy(buf, r.buf[r.head:end])
+		} else {
+			k := copy(buf, r.buf[r.head:])
+			copy(buf[k:], r.buf[:end-len(r.buf)])
+		}
+	}
+	r.buf, r.head = buf, 0
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ExampleRing() {
+	var q Ring[string]
+	for _, s := range []string{"a", "b", "c"} {
+		q.Push(s)
+	}
+	fmt.Print(q.Pop())
+	q.Push("d")
+	for q.Len() > 0 {
+		fmt.Print(q.Pop())
+	}
+	// Output: abcd
+}
+
+func TestRingOrder(t *testing.T) {
+	var q Ring[int]
+	next, want := 0, 0
+	// pushes and pops in uneven steps so the items wrap around the array while it grows and shrinks
+	for round := 1; round <= 50; round++ {
+		for i := 0; i < round*3; i++ {
+			q.Push(next)
+			next++
+		}
+		for i := 0; i < round*2; i++ {
+			if v := q.Pop(); v != want {
+				t.Fatalf("Pop = %d, want %d", v, want)
+			}
+			want++
+		}
+		for i := 0; i < q.Len(); i++ {
+			if v := q.At(i); v != want+i {
+				t.Fatalf("At(%d) = %d, want %d", i, v, want+i)
+			}
+		}
+	}
+	for q.Len() > 0 {
+		if v := q.Pop(); v != want {
+			t.Fatalf("Pop = %d, want %d", v, want)
+		}
+		want++
+	}
+	if want != next {
+		t.Errorf("popped %d items, want %d", want, next)
+	}
+	if c := q.Cap(); c != minCap {
+		t.Errorf("Cap of the emptied queue = %d, want %d", c, minCap)
+	}
+}
+
+func TestRingFloor(t *testing.T) {
+	q := New[int](100)
+	for i := 0; i < 100; i++ {
+		q.Push(i)
+	}
+	for q.Len() > 0 {
+		q.Pop()
+	}
+	if c := q.Cap(); c != 100 {
+		t.Errorf("Cap = %d, want 100", c)
+	}
+	if n := testing.AllocsPerRun(10, func() {
+		for i := 0; i < 100; i++ {
+			q.Push(i)
+		}
+		for q.Len() > 0 {
+			q.Pop()
+		}
+	}); n != 0 {
+		t.Errorf("%v allocations to fill and empty the queue, want 0", n)
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	var q Ring[int]
+	defer func() {
+		if recover() == nil {
+			t.Error("Pop of an empty queue did not panic")
+		}
+	}()
+	q.Pop()
+}
+
+// fill runs loops items through a queue of at most size items: it fills the queue, then takes
+// one item for each one it adds, and empties it at the end, like a bounded buffer with a slow receiver.
+func fill(loops, size int, push func(int), pop func()) {
+	n := 0
+	for i := 0; i < loops; i++ {
+		if n == size {
+			pop()
+			n--
+		}
+		push(i)
+		n++
+	}
+	for ; n > 0; n-- {
+		pop()
+	}
+}
+
+const loops = 30000
+
+func benchSlice(b *testing.B, size int) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var q []int
+		fill(loops, size, func(v int) { q = append(q, v) }, func() { q = q[1:] })
+	}
+}
+
+func benchRing(b *testing.B, size int) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var q Ring[int]
+		fill(loops, size, q.Push, func() { q.Pop() })
+	}
+}
+
+func BenchmarkSlice1(b *testing.B)    { benchSlice(b, 1) }
+func BenchmarkRing1(b *testing.B)     { benchRing(b, 1) }
+func BenchmarkSlice2(b *testing.B)    { benchSlice(b, 2) }
+func BenchmarkRing2(b *testing.B)     { benchRing(b, 2) }
+func BenchmarkSlice200(b *testing.B)  { benchSlice(b, 200) }
+func BenchmarkRing200(b *testing.B)   { benchRing(b, 200) }
+func BenchmarkSlice1000(b *testing.B) { benchSlice(b, 1000) }
+func BenchmarkRing1000(b *testing.B)  { benchRing(b, 1000) }
+func BenchmarkSlice2000(b *testing.B) { benchSlice(b, 2000) }
+func BenchmarkRing2000(b *testing.B)  { benchRing(b, 2000) }
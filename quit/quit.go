@@ -0,0 +1,151 @@
+// Package quit broadcasts a stop to a group of goroutines and waits for each of them to acknowledge it,
+// grown from cmd/comms: closed.go broadcasts by closing a channel, subordinates.go stops its members one
+// by one and waits for the ack of each.
+//
+// Every goroutine of a Group has a Member. It watches Stopping, which is closed when the Group stops,
+// and calls Ack once it has stopped, or when it ends on its own. Stop tells all the members at once and
+// waits for their acks until its context is done, then names the members which have not acknowledged.
+package quit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Member is the end of a goroutine in a Group. A nil *Member is never stopped and its Ack does nothing,
+// so code which may run outside of a Group does not need to check.
+type Member struct {
+	stop     chan struct{} // closed when the Group stops
+	stopOnce sync.Once
+	acked    chan struct{} // closed by Ack
+	ackOnce  sync.Once
+}
+
+// NewMember returns a Member which is not in a Group yet, for a goroutine which may start before it is added.
+func NewMember() *Member {
+	return &Member{stop: make(chan struct{}), acked: make(chan struct{})}
+}
+
+// Stopping returns a channel which is closed when the Group of m stops.
+func (m *Member) Stopping() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	return m.stop
+}
+
+// Ack tells the Group m has stopped. It can be called before the Group stops, by a goroutine ending on its own,
+// and more than once.
+func (m *Member) Ack() {
+	if m == nil {
+		return
+	}
+	m.ackOnce.Do(func() { close(m.acked) })
+}
+
+func (m *Member) signal() { m.stopOnce.Do(func() { close(m.stop) }) }
+
+func (m *Member) done() bool {
+	select {
+	case <-m.acked:
+		return true
+	default:
+		return false
+	}
+}
+
+// Group is a set of Members stopped together. The zero value is an empty Group which has not stopped.
+type Group struct {
+	mu      sync.Mutex
+	members []named
+	stopped bool
+	sweepAt int // count of members from which the acknowledged ones are dropped
+}
+
+type named struct {
+	name string
+	m    *Member
+}
+
+// StragglerError is returned by Stop when some members have not acknowledged the stop in time.
+type StragglerError struct {
+	Stragglers []string // names of the members, in the order they were added
+}
+
+func (e *StragglerError) Error() string {
+	return fmt.Sprintf("%d not stopped: %s", len(e.Stragglers), strings.Join(e.Stragglers, ", "))
+}
+
+// Join adds a new Member named name to g and returns it.
+func (g *Group) Join(name string) *Member {
+	m := NewMember()
+	g.Add(m, name)
+	return m
+}
+
+// Add adds m to g under name, which is how Stop reports it when it does not acknowledge. When g has stopped
+// already, m is stopped at once.
+func (g *Group) Add(m *Member, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		m.signal()
+	}
+	if len(g.members) >= g.sweepAt {
+		// drop the members which have ended on their own, so a long lived Group does not grow
+		live := g.members[:0]
+		for _, n := range g.members {
+			if !n.m.done() {
+				live = append(live, n)
+			}
+		}
+		for i := len(live); i < len(g.members); i++ {
+			g.members[i] = named{}
+		}
+		g.members = live
+		g.sweepAt = 2*len(live) + 16
+	}
+	g.members = append(g.members, named{name, m})
+}
+
+// Stop tells all the members of g to stop at once and waits for their acks until ctx is done. It returns
+// a *StragglerError naming the members which have not acknowledged by then, nil when all have. The wait
+// lasts as long as the slowest member, not as long as all of them together.
+// Stop can be called again to wait longer, the members are only told once.
+func (g *Group) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	g.stopped = true
+	members := append([]named(nil), g.members...)
+	g.mu.Unlock()
+
+	for _, n := range members {
+		n.m.signal()
+	}
+	for i, n := range members {
+		select {
+		case <-n.m.acked:
+		case <-ctx.Done():
+			// the ones left behind may still have acknowledged
+			var late []string
+			for _, n := range members[i:] {
+				if !n.m.done() {
+					late = append(late, n.name)
+				}
+			}
+			if len(late) == 0 {
+				return nil
+			}
+			return &StragglerError{Stragglers: late}
+		}
+	}
+	return nil
+}
+
+// Stopped returns whether Stop has been called.
+func (g *Group) Stopped() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stopped
+}
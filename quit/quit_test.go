@@ -0,0 +1,120 @@
+package quit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleGroup() {
+	var g Group
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		m := g.Join(fmt.Sprint("talker ", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer m.Ack()
+			<-m.Stopping() // talk until told to stop
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fmt.Println(g.Stop(ctx))
+	wg.Wait()
+	// Output: <nil>
+}
+
+func TestStopStragglers(t *testing.T) {
+	var g Group
+	fast, slow, gone := g.Join("fast"), g.Join("slow"), g.Join("gone")
+	gone.Ack() // it has ended on its own
+	go func() {
+		<-fast.Stopping()
+		fast.Ack()
+	}()
+	release := make(chan struct{})
+	go func() {
+		<-slow.Stopping()
+		<-release
+		slow.Ack()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := g.Stop(ctx)
+	var se *StragglerError
+	if !errors.As(err, &se) || !reflect.DeepEqual(se.Stragglers, []string{"slow"}) {
+		t.Fatalf("Stop = %v, want slow not stopped", err)
+	}
+
+	// Stop again waits for the straggler.
+	close(release)
+	if err := g.Stop(context.Background()); err != nil {
+		t.Errorf("second Stop = %v, want nil", err)
+	}
+	if !g.Stopped() {
+		t.Error("Stopped = false after Stop")
+	}
+}
+
+func TestAddAfterStop(t *testing.T) {
+	var g Group
+	if err := g.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m := g.Join("late")
+	select {
+	case <-m.Stopping():
+	default:
+		t.Error("a member added to a stopped group is not stopped")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	var g Group
+	for i := 0; i < 1000; i++ {
+		g.Join(fmt.Sprint(i)).Ack()
+	}
+	if n := len(g.members); n > 100 {
+		t.Errorf("%d members kept, want the acknowledged ones dropped", n)
+	}
+}
+
+func TestNilMember(t *testing.T) {
+	var m *Member
+	m.Ack()
+	select {
+	case <-m.Stopping():
+		t.Error("a nil member is stopped")
+	default:
+	}
+}
+
+// TestStopParallel checks that stopping 500 members, like cmd/comms/subordinates.go, takes as long as the
+// slowest of them rather than all of them together.
+func TestStopParallel(t *testing.T) {
+	const n, slow = 500, 20 * time.Millisecond
+	var g Group
+	for i := 0; i < n; i++ {
+		m := g.Join(fmt.Sprint("subordinate ", i+1))
+		go func() {
+			<-m.Stopping()
+			time.Sleep(slow) // finishes what it was doing
+			m.Ack()
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := g.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*slow {
+		t.Errorf("stopping took %v, want about %v", d, slow)
+	}
+}
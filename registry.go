@@ -0,0 +1,158 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNoFn is sent to Request.Err when a Worker gets a request without Fn nor a Task of a Registry to run.
+var ErrNoFn = errors.New("request has nothing to run")
+
+// Task describes the work of a Request as data, the name of a task in a Registry and its encoded payload,
+// so it can be sent to a remote Worker, written to a file and replayed.
+type Task struct {
+	Name    string `json:"name"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// A Handler runs a task with its encoded payload.
+type Handler func(payload []byte) (int, error)
+
+// A Codec encodes and decodes the payloads of tasks.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// The Codecs of payloads: JSON is readable and understood by other languages,
+// Gob is more compact for Go types.
+var (
+	JSON Codec = jsonCodec{}
+	Gob  Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// UnknownTaskError is the error of running a task which is not in the Registry.
+type UnknownTaskError struct {
+	Name string
+}
+
+func (e *UnknownTaskError) Error() string { return fmt.Sprintf("unknown task %q", e.Name) }
+
+// Registry maps the names of tasks to their Handlers. It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	tasks map[string]task
+}
+
+type task struct {
+	h     Handler
+	codec Codec // of the payload, nil when h takes the bytes as they are
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{tasks: make(map[string]task)}
+}
+
+// Register adds the task of name, whose Handler takes the payload as it is, replacing the task of name it had.
+func (r *Registry) Register(name string, h Handler) {
+	r.add(name, task{h: h})
+}
+
+func (r *Registry) add(name string, t task) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tasks[name] = t
+}
+
+// Handle adds the task of name to r, whose payload is a T encoded by c, replacing the task of name it had.
+func Handle[T any](r *Registry, name string, c Codec, fn func(T) (int, error)) {
+	r.add(name, task{
+		h: func(payload []byte) (int, error) {
+			var v T
+			if err := c.Unmarshal(payload, &v); err != nil {
+				return 0, fmt.Errorf("task %q: %s payload: %w", name, c.Name(), err)
+			}
+			return fn(v)
+		},
+		codec: c,
+	})
+}
+
+// Task returns the task of name with payload encoded by the Codec of the task.
+// The payload of a task added by Register has to be a []byte.
+func (r *Registry) Task(name string, payload any) (Task, error) {
+	r.mu.RLock()
+	t, ok := r.tasks[name]
+	r.mu.RUnlock()
+	if !ok {
+		return Task{}, &UnknownTaskError{Name: name}
+	}
+	if t.codec == nil {
+		b, ok := payload.([]byte)
+		if !ok {
+			return Task{}, fmt.Errorf("task %q takes a []byte payload, not %T", name, payload)
+		}
+		return Task{Name: name, Payload: b}, nil
+	}
+	b, err := t.codec.Marshal(payload)
+	if err != nil {
+		return Task{}, fmt.Errorf("task %q: %s payload: %w", name, t.codec.Name(), err)
+	}
+	return Task{Name: name, Payload: b}, nil
+}
+
+// Request returns a request for t, which local Workers run with r and remote Workers with theirs.
+// Its Result and Err are left for the caller to set, a failed task is reported on Err.
+func (r *Registry) Request(t Task) Request {
+	return Request{Task: &t, registry: r}
+}
+
+// Run runs t with its Handler.
+func (r *Registry) Run(t Task) (int, error) {
+	r.mu.RLock()
+	task, ok := r.tasks[t.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, &UnknownTaskError{Name: t.Name}
+	}
+	return task.h(t.Payload)
+}
+
+// Names returns the names of the tasks in order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.tasks))
+	for name := range r.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
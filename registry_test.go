@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+type resize struct {
+	Width, Height int
+}
+
+func ExampleHandle() {
+	r := NewRegistry()
+	Handle(r, "area", Gob, func(p resize) (int, error) { return p.Width * p.Height, nil })
+
+	// The task is data: it can be sent to remote workers, stored and run later.
+	t, err := r.Task("area", resize{Width: 4, Height: 3})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(r.Run(t))
+	// Output:
+	// 12 <nil>
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	Handle(r, "len", JSON, func(s string) (int, error) { return len(s), nil })
+	r.Register("raw", func(p []byte) (int, error) { return len(p), nil })
+
+	task, err := r.Task("len", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(task.Payload) != `"hello"` {
+		t.Errorf("payload = %s, want JSON", task.Payload)
+	}
+	if _, err := r.Task("raw", "not bytes"); err == nil {
+		t.Error("raw task takes a string")
+	}
+	var unknown *UnknownTaskError
+	if _, err := r.Task("missing", nil); !errors.As(err, &unknown) {
+		t.Errorf("err = %v, want UnknownTaskError", err)
+	}
+	if _, err := r.Run(Task{Name: "len", Payload: []byte("{")}); err == nil || !strings.Contains(err.Error(), "json payload") {
+		t.Errorf("err = %v, want a payload error", err)
+	}
+	if got := strings.Join(r.Names(), ","); got != "len,raw" {
+		t.Errorf("names = %s", got)
+	}
+}
+
+func TestRegistryRequest(t *testing.T) {
+	r := NewRegistry()
+	Handle(r, "half", JSON, func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, fmt.Errorf("%d is odd", n)
+		}
+		return n / 2, nil
+	})
+	b := &Balancer{Out: io.Discard}
+	w := NewWorker(make(chan Request, 2))
+	comp := make(chan *Worker, 2)
+	go w.Work(comp)
+	in := make(chan Request)
+	go b.Balance(Pool{&w}, in, comp)
+	defer close(in)
+
+	res, errc := make(chan int, 1), make(chan error, 1)
+	send := func(n int) {
+		task, err := r.Task("half", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := r.Request(task)
+		req.Result, req.Err = res, errc
+		in <- req
+	}
+	send(8)
+	if v := <-res; v != 4 {
+		t.Errorf("result = %d, want 4", v)
+	}
+	send(7)
+	if err := <-errc; err == nil || err.Error() != "7 is odd" {
+		t.Errorf("err = %v, want 7 is odd", err)
+	}
+	in <- Request{Result: res, Err: errc}
+	if err := <-errc; !errors.Is(err, ErrNoFn) {
+		t.Errorf("err = %v, want ErrNoFn", err)
+	}
+}
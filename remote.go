@@ -0,0 +1,412 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"funmech.com/loadbalancer/internal/wire"
+)
+
+var (
+	// ErrWorkerLost is sent to Request.Err when the remote Worker running the request has failed.
+	ErrWorkerLost = errors.New("remote worker lost")
+	// ErrNoTask is sent to Request.Err when a request without a Task is sent to a remote Worker,
+	// which cannot run Request.Fn. Select the remote Workers by their task capabilities to avoid it.
+	ErrNoTask = errors.New("request has no task for a remote worker")
+)
+
+// remoteWindow is how many requests a remote Worker has at most: one in hand and one on the way,
+// so it does not wait for a round trip between two requests. The rest stay in its request channel.
+const remoteWindow = 2
+
+// maxRemoteBuffer is the largest request channel an agent may ask for in its Hello.
+const maxRemoteBuffer = 1 << 12
+
+// defaultHeartbeat is how often a RemoteServer pings its agents when RemoteServer.Heartbeat is zero.
+const defaultHeartbeat = time.Second
+
+// TaskCapability returns the capability a remote Worker has for each task it can run, to be used in
+// a Selector, like Selector{TaskCapability("resize"): "true"}.
+func TaskCapability(name string) string { return "task:" + name }
+
+// RemoteServer lets remote processes join a Balancer as Workers, see Agent. A remote Worker is in the heap like
+// any other: its pending counts the requests sent to it and not completed yet, and it completes them in order.
+type RemoteServer struct {
+	Balancer *Balancer
+	// Heartbeat is how often agents are pinged, one second when it is zero.
+	// An agent which has not answered for three heartbeats is ejected and its requests fail with ErrWorkerLost.
+	Heartbeat time.Duration
+}
+
+func (s *RemoteServer) heartbeat() time.Duration {
+	if s.Heartbeat <= 0 {
+		return defaultHeartbeat
+	}
+	return s.Heartbeat
+}
+
+// Serve accepts agents on l until it fails, and adds each of them to the Balancer.
+func (s *RemoteServer) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.join(c)
+	}
+}
+
+// join adds the agent on c to the Balancer once it has said hello.
+func (s *RemoteServer) join(c net.Conn) {
+	conn := wire.NewConn(c)
+	c.SetReadDeadline(time.Now().Add(3 * s.heartbeat()))
+	var hello wire.Hello
+	kind, body, err := conn.Recv()
+	if err == nil && kind != wire.KindHello {
+		err = fmt.Errorf("expected hello, got message of kind %d", kind)
+	}
+	if err == nil {
+		err = wire.Decode(kind, body, &hello)
+	}
+	if err == nil && (hello.Buffer < 0 || hello.Buffer > maxRemoteBuffer) {
+		err = fmt.Errorf("buffer %d is not between 0 and %d", hello.Buffer, maxRemoteBuffer)
+	}
+	if err == nil && hello.Weight < 0 {
+		err = fmt.Errorf("weight %d is negative", hello.Weight)
+	}
+	if err != nil {
+		fmt.Fprintf(s.Balancer.out(), "Remote worker %v failed to join: %v\n", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	caps := make(map[string]string, len(hello.Capabilities)+len(hello.Tasks))
+	for k, v := range hello.Capabilities {
+		caps[k] = v
+	}
+	for _, name := range hello.Tasks {
+		caps[TaskCapability(name)] = "true"
+	}
+	w := NewWorker(make(chan Request, hello.Buffer))
+	w.SetWeight(hello.Weight)
+	w.SetLabels(Labels{Zone: hello.Zone, Region: hello.Region, Host: hello.Host})
+	w.SetCapabilities(caps)
+	w.remote = &remote{
+		b:        s.Balancer,
+		c:        c,
+		conn:     conn,
+		interval: s.heartbeat(),
+		inflight: make(map[uint64]flight),
+		lost:     make(chan struct{}),
+		results:  make(chan outcome, remoteWindow),
+		slots:    make(chan struct{}, remoteWindow),
+	}
+	w.remote.seen.Store(time.Now().UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+	// The Welcome has to be sent before the Worker can get a Task, so it is sent in the balancer goroutine,
+	// which an agent not reading must not hold up for long.
+	b := s.Balancer
+	err = b.do(ctx, func() error {
+		b.mu.Lock()
+		b.register(&w)
+		b.mu.Unlock()
+		c.SetWriteDeadline(time.Now().Add(s.heartbeat()))
+		err := conn.Send(wire.KindWelcome, wire.Welcome{ID: w.id})
+		c.SetWriteDeadline(time.Time{})
+		if err != nil {
+			b.mu.Lock()
+			delete(b.workers, w.id)
+			b.mu.Unlock()
+			return err
+		}
+		b.start(&w)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(s.Balancer.out(), "Remote worker %v failed to join: %v\n", c.RemoteAddr(), err)
+		c.Close()
+	}
+}
+
+// remote is the connection to the agent behind a remote Worker.
+type remote struct {
+	b        *Balancer
+	c        net.Conn
+	conn     *wire.Conn
+	interval time.Duration
+	seen     atomic.Int64 // UnixNano of the last message from the agent
+	closed   atomic.Bool  // the connection is being closed after the Worker has been retired
+
+	mu       sync.Mutex
+	next     uint64
+	inflight map[uint64]flight // requests sent to the agent by the IDs of their Tasks
+	once     sync.Once
+	lost     chan struct{} // closed when the agent is lost
+	err      error         // why the agent is lost
+
+	results chan outcome  // requests to be answered to their requesters, in order
+	slots   chan struct{} // a slot for each request between taken from the request channel and answered
+	wg      sync.WaitGroup
+}
+
+type flight struct {
+	req  Request
+	span Span // the "execute" span, when there is a Tracer
+}
+
+type outcome struct {
+	flight
+	value int
+	err   error
+}
+
+// serve sends the requests of w to the agent and answers them with what it sends back.
+func (r *remote) serve(w *Worker, done chan *Worker) {
+	stop := make(chan struct{})
+	go r.deliver(w, done)
+	go r.read(w)
+	go r.ping(w, stop)
+	for req := range w.request {
+		r.slots <- struct{}{}
+		r.wg.Add(1)
+		r.send(w, req)
+	}
+	// The Worker has been retired or ejected: wait for its requests before hanging up.
+	r.wg.Wait()
+	close(stop)
+	close(r.results)
+	r.closed.Store(true)
+	r.c.Close()
+}
+
+func (r *remote) send(w *Worker, req Request) {
+	f := flight{req: req}
+	if req.tracer != nil {
+		req.queued.End()
+		f.span = req.tracer.Start(req.Trace, "execute")
+		f.span.SetAttribute("worker.id", w.id)
+		f.span.SetAttribute("worker.remote", r.c.RemoteAddr().String())
+	}
+	if req.Task == nil {
+		r.results <- outcome{flight: f, err: ErrNoTask}
+		return
+	}
+	r.mu.Lock()
+	select {
+	case <-r.lost:
+		r.mu.Unlock()
+		r.results <- outcome{flight: f, err: r.err}
+		return
+	default:
+	}
+	r.next++
+	id := r.next
+	r.inflight[id] = f
+	r.mu.Unlock()
+	if err := r.conn.Send(wire.KindTask, wire.Task{ID: id, Name: req.Task.Name, Payload: req.Task.Payload}); err != nil {
+		r.lose(w, err) // which fails the request too
+	}
+}
+
+// read takes the messages of the agent until the connection fails.
+func (r *remote) read(w *Worker) {
+	for {
+		kind, body, err := r.conn.Recv()
+		if err != nil {
+			if !r.closed.Load() {
+				r.lose(w, err)
+			}
+			return
+		}
+		r.seen.Store(time.Now().UnixNano())
+		switch kind {
+		case wire.KindPong:
+		case wire.KindResult:
+			var res wire.Result
+			if err := wire.Decode(kind, body, &res); err != nil {
+				r.lose(w, err)
+				return
+			}
+			r.mu.Lock()
+			f, ok := r.inflight[res.ID]
+			delete(r.inflight, res.ID)
+			r.mu.Unlock()
+			if !ok {
+				continue // it has failed already
+			}
+			o := outcome{flight: f, value: res.Value}
+			if res.Err != "" {
+				o.err = errors.New(res.Err)
+			}
+			r.results <- o
+		default:
+			r.lose(w, fmt.Errorf("unexpected message of kind %d", kind))
+			return
+		}
+	}
+}
+
+// deliver answers the requesters and tells the Balancer, like Worker.Work does.
+// It never holds up read, which keeps taking heartbeats while a requester is slow.
+func (r *remote) deliver(w *Worker, done chan *Worker) {
+	for o := range r.results {
+		if o.span != nil {
+			o.span.End()
+		}
+		if o.req.root != nil {
+			o.req.root.End()
+		}
+		if o.err != nil {
+			if o.req.Err != nil {
+				go func(errc chan error, err error) { errc <- err }(o.req.Err, o.err)
+			}
+		} else {
+			o.req.Result <- o.value
+		}
+		if !errors.Is(o.err, ErrWorkerLost) {
+			o.req.ack() // a lost one is recovered after a crash, another Worker may run it
+		}
+		w.finished(done, o.err)
+		<-r.slots
+		r.wg.Done()
+	}
+}
+
+// ping sends heartbeats and gives the agent up when it has not answered for three of them.
+func (r *remote) ping(w *Worker, stop chan struct{}) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.lost:
+			return
+		case now := <-t.C:
+			if now.Sub(time.Unix(0, r.seen.Load())) > 3*r.interval {
+				r.lose(w, errors.New("no heartbeat"))
+				return
+			}
+			if err := r.conn.Send(wire.KindPing, nil); err != nil {
+				r.lose(w, err)
+				return
+			}
+		}
+	}
+}
+
+// lose fails the requests sent to the agent, hangs up and ejects the Worker from the Balancer.
+// The requests still coming from the request channel fail as well until the Balancer has closed it.
+func (r *remote) lose(w *Worker, cause error) {
+	r.once.Do(func() {
+		r.mu.Lock()
+		r.err = fmt.Errorf("%w: %v", ErrWorkerLost, cause)
+		close(r.lost)
+		for id, f := range r.inflight {
+			delete(r.inflight, id)
+			r.results <- outcome{flight: f, err: r.err}
+		}
+		r.mu.Unlock()
+		r.c.Close()
+		go r.b.EjectWorker(context.Background(), w.id, r.err)
+	})
+}
+
+// Agent runs the tasks a remote Balancer sends to it, see RemoteServer.
+// It runs them one after another, in the order they come.
+type Agent struct {
+	Registry     *Registry
+	Buffer       int // capacity of the request channel of the Worker in the Balancer
+	Weight       int
+	Labels       Labels
+	Capabilities map[string]string
+}
+
+// Run joins the Balancer on c and runs its tasks until the connection is closed. It returns nil when
+// the Balancer has hung up after removing the Worker, and the ID the Balancer has given to the Worker.
+func (a *Agent) Run(c net.Conn) (int, error) {
+	defer c.Close()
+	conn := wire.NewConn(c)
+	err := conn.Send(wire.KindHello, wire.Hello{
+		Buffer:       a.Buffer,
+		Weight:       a.Weight,
+		Zone:         a.Labels.Zone,
+		Region:       a.Labels.Region,
+		Host:         a.Labels.Host,
+		Capabilities: a.Capabilities,
+		Tasks:        a.Registry.Names(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	kind, body, err := conn.Recv()
+	if err != nil {
+		return 0, err
+	}
+	var welcome wire.Welcome
+	if kind != wire.KindWelcome {
+		return 0, fmt.Errorf("expected welcome, got message of kind %d", kind)
+	}
+	if err := wire.Decode(kind, body, &welcome); err != nil {
+		return 0, err
+	}
+
+	// The Balancer sends no more than remoteWindow tasks before it has their results,
+	// so the reader never waits for the runner.
+	tasks := make(chan wire.Task, remoteWindow)
+	failed := make(chan error, 1)
+	defer close(tasks)
+	go func() {
+		for t := range tasks {
+			res := wire.Result{ID: t.ID}
+			v, err := a.Registry.Run(Task{Name: t.Name, Payload: t.Payload})
+			if err != nil {
+				res.Err = err.Error()
+			} else {
+				res.Value = v
+			}
+			if err := conn.Send(wire.KindResult, res); err != nil {
+				failed <- err
+				c.Close()
+				return
+			}
+		}
+	}()
+	for {
+		kind, body, err := conn.Recv()
+		if err != nil {
+			select {
+			case err := <-failed:
+				return welcome.ID, err
+			default:
+			}
+			if errors.Is(err, io.EOF) {
+				return welcome.ID, nil
+			}
+			return welcome.ID, err
+		}
+		switch kind {
+		case wire.KindPing:
+			if err := conn.Send(wire.KindPong, nil); err != nil {
+				return welcome.ID, err
+			}
+		case wire.KindTask:
+			var t wire.Task
+			if err := wire.Decode(kind, body, &t); err != nil {
+				return welcome.ID, err
+			}
+			tasks <- t
+		default:
+			return welcome.ID, fmt.Errorf("unexpected message of kind %d", kind)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"funmech.com/loadbalancer/internal/wire"
+)
+
+// remoteBalancer starts a balancer without workers taking agents on a local port, it returns the address.
+func remoteBalancer(t *testing.T, heartbeat time.Duration) (*Balancer, chan Request, string) {
+	t.Helper()
+	b := &Balancer{Out: io.Discard}
+	r := make(chan Request)
+	go b.Balance(nil, r, make(chan *Worker, 8))
+	t.Cleanup(func() { close(r) })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &RemoteServer{Balancer: b, Heartbeat: heartbeat}
+	go s.Serve(l)
+	return b, r, l.Addr().String()
+}
+
+// waitWorkers waits until b has n workers.
+func waitWorkers(t *testing.T, b *Balancer, n int) Snapshot {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s, err := b.Snapshot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Workers) == n {
+			return s
+		}
+	}
+	t.Fatalf("balancer does not have %d workers", n)
+	return Snapshot{}
+}
+
+func TestRemoteWorker(t *testing.T) {
+	b, r, addr := remoteBalancer(t, 0)
+	reg := NewRegistry()
+	reg.Register("double", func(payload []byte) (int, error) {
+		var n int
+		err := json.Unmarshal(payload, &n)
+		return 2 * n, err
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{Registry: reg, Buffer: 4, Labels: Labels{Zone: "far"}}
+	ran := make(chan error, 1)
+	go func() {
+		_, err := a.Run(c)
+		ran <- err
+	}()
+
+	s := waitWorkers(t, b, 1)
+	if w := s.Workers[0]; w.QueueCap != 4 || w.Labels.Zone != "far" || w.Capabilities[TaskCapability("double")] != "true" {
+		t.Errorf("worker = %+v", w)
+	}
+
+	res, errc := make(chan int, 8), make(chan error, 8)
+	sel := Selector{TaskCapability("double"): "true"}
+	for i := 1; i <= 5; i++ {
+		r <- Request{Task: &Task{Name: "double", Payload: []byte{byte('0' + i)}}, Result: res, Err: errc, Selector: sel}
+	}
+	for i := 1; i <= 5; i++ {
+		select {
+		case v := <-res:
+			if v != 2*i {
+				t.Errorf("result %d = %d, want %d", i, v, 2*i)
+			}
+		case err := <-errc:
+			t.Fatal(err)
+		}
+	}
+	r <- Request{Task: &Task{Name: "triple"}, Result: res, Err: errc}
+	if err := <-errc; err == nil || err.Error() != `unknown task "triple"` {
+		t.Errorf("err = %v, want the unknown task", err)
+	}
+	r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc}
+	if err := <-errc; !errors.Is(err, ErrNoTask) {
+		t.Errorf("err = %v, want ErrNoTask", err)
+	}
+
+	if err := b.RemoveWorker(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("agent: %v", err)
+	}
+}
+
+func TestRemoteHeartbeat(t *testing.T) {
+	b, r, addr := remoteBalancer(t, 10*time.Millisecond)
+	events := make(chan Event, 16)
+	b.Observe(ObserverFunc(func(e Event) { events <- e }), 16)
+
+	// An agent which joins and then hangs.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := wire.NewConn(c)
+	if err := conn.Send(wire.KindHello, wire.Hello{Buffer: 1, Tasks: []string{"sleep"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	r <- Request{Task: &Task{Name: "sleep"}, Result: make(chan int, 1), Err: errc}
+	if err := <-errc; !errors.Is(err, ErrWorkerLost) {
+		t.Errorf("err = %v, want ErrWorkerLost", err)
+	}
+	for e := range events {
+		if e.Kind == WorkerEjected {
+			if !errors.Is(e.Err, ErrWorkerLost) {
+				t.Errorf("ejected for %v", e.Err)
+			}
+			break
+		}
+	}
+}
+
+func TestRemoteBadHello(t *testing.T) {
+	b, _, addr := remoteBalancer(t, 0)
+	for _, hello := range []wire.Hello{{Buffer: -1}, {Buffer: maxRemoteBuffer + 1}, {Weight: -1}} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := wire.NewConn(c)
+		if err := conn.Send(wire.KindHello, hello); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.Recv(); err == nil {
+			t.Errorf("hello %+v: welcomed, want the connection closed", hello)
+		}
+		c.Close()
+	}
+	if s := waitWorkers(t, b, 0); len(s.Workers) != 0 {
+		t.Errorf("workers = %+v, want none", s.Workers)
+	}
+}
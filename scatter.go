@@ -0,0 +1,200 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrTooFewWorkers is sent to Request.Err when a scattered request has more copies than there are Workers to take them.
+	ErrTooFewWorkers = errors.New("fewer workers than copies of the request")
+	// ErrQuorum is sent to Request.Err when the Quorum of a scattered request with GatherQuorum is not between 1 and its Copies.
+	ErrQuorum = errors.New("quorum out of the copies of the request")
+	// ErrNoResult is sent to Request.Err when a scattered request has neither Scatter.Results nor Request.Result.
+	ErrNoResult = errors.New("no channel for the results of the request")
+)
+
+// Gather tells when a scattered request completes.
+type Gather int
+
+const (
+	GatherAll    Gather = iota // once every copy has returned, for map-style jobs
+	GatherFirst                // with the first result, for hedged reads
+	GatherQuorum               // once Scatter.Quorum copies have returned
+)
+
+func (g Gather) String() string {
+	switch g {
+	case GatherAll:
+		return "all"
+	case GatherFirst:
+		return "first"
+	case GatherQuorum:
+		return "quorum"
+	}
+	return fmt.Sprintf("Gather(%d)", int(g))
+}
+
+// Scatter sends a request to several distinct Workers at once, the least loaded ones which can take it,
+// in the zone of the request first. Each copy is a request of its own for the Worker running it, it counts
+// in its pending until it completes. With a Balancer.FairQueue, the copies wait in the queue of the tenant.
+// Once the request has gathered the results it needs, the copies not started yet are skipped and Part
+// is told to give up, see Request.Scatter.
+type Scatter struct {
+	Copies int // count of Workers to send the request to
+	Gather Gather
+	Quorum int // count of results GatherQuorum needs, from 1 to Copies
+	// Part, when set, is run by the i-th copy instead of Request.Fn, for map-style jobs. Its ctx is cancelled
+	// once the request has gathered its results, so a losing copy can give up.
+	Part func(ctx context.Context, i int) int
+	// Results, when set, receives the gathered values in the order they have come,
+	// otherwise Request.Result receives the first one. One of them has to be set.
+	Results chan []int
+}
+
+// GatherError is sent to Request.Err when too many copies of a scattered request have failed
+// for it to gather the results it needs.
+type GatherError struct {
+	Needed int     // count of results the request needed
+	Copies int     // count of copies sent
+	Errs   []error // errors of the failed copies
+}
+
+func (e *GatherError) Error() string {
+	return fmt.Sprintf("%d of %d copies failed, %d results needed: %v", len(e.Errs), e.Copies, e.Needed, e.Errs[0])
+}
+
+func (e *GatherError) Unwrap() []error { return e.Errs }
+
+// needs returns the count of results a request with s needs out of n copies.
+func (s *Scatter) needs(n int) int {
+	switch s.Gather {
+	case GatherFirst:
+		return 1
+	case GatherQuorum:
+		return s.Quorum
+	}
+	return n
+}
+
+// scatter dispatches a copy of req to each of the least loaded Workers of p which can take it,
+// or queues the copies in the FairQueue.
+func (b *Balancer) scatter(req Request, p Pool) {
+	s := req.Scatter
+	n := s.Copies
+	if n < 1 {
+		n = 1
+	}
+	if s.Results == nil && req.Result == nil {
+		b.reject(req, ErrNoResult)
+		return
+	}
+	if s.Gather == GatherQuorum && (s.Quorum < 1 || s.Quorum > n) {
+		b.reject(req, fmt.Errorf("%w: %d of %d copies", ErrQuorum, s.Quorum, n))
+		return
+	}
+	ws := make([]*Worker, 0, len(p))
+	for _, w := range p {
+		if w.available() {
+			ws = append(ws, w)
+		}
+	}
+	if len(ws) < n {
+		b.reject(req, ErrTooFewWorkers)
+		return
+	}
+	// Like pick, the Workers in the zone of the request come first unless they spill.
+	local := func(w *Worker) bool { return req.Zone != "" && w.labels.Zone == req.Zone && !b.spills(w) }
+	sort.Slice(ws, func(i, j int) bool {
+		if li, lj := local(ws[i]), local(ws[j]); li != lj {
+			return li
+		}
+		return lighter(ws[i], ws[j])
+	})
+	ws = ws[:n]
+
+	if b.Tracer != nil && !req.Trace.IsValid() {
+		// one trace for all the copies
+		req.root = b.Tracer.Start(SpanContext{}, "request")
+		req.Trace = req.root.Context()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results, errc := make(chan int, n), make(chan error, n) // the losers never wait
+	b.emit(Event{Kind: RequestAccepted})
+	go gather(req, s.needs(n), n, results, errc, cancel)
+	siblings := make(map[*Worker]bool, n)
+	for i, w := range ws {
+		cp := req
+		cp.Scatter, cp.Result, cp.Err = nil, results, errc
+		cp.root, cp.log = nil, nil // ended and acknowledged once by gather
+		switch {
+		case s.Part != nil:
+			part, i := s.Part, i
+			cp.Fn = func() int {
+				if ctx.Err() != nil {
+					return 0 // skipped, the request is complete
+				}
+				return part(ctx, i)
+			}
+		case req.Fn != nil:
+			fn := req.Fn
+			cp.Fn = func() int {
+				if ctx.Err() != nil {
+					return 0
+				}
+				return fn()
+			}
+		}
+		// every copy is dispatched and completed like a request
+		if b.FairQueue == nil {
+			b.dispatched++
+			b.dispatch(cp, w)
+			continue
+		}
+		// A queued copy goes to the Worker which has room when its turn comes, but not to one of its siblings.
+		cp.siblings = siblings
+		if !b.FairQueue.push(cp, time.Now()) {
+			b.reject(cp, ErrQueueFull)
+			continue
+		}
+		b.dispatched++
+	}
+	if b.FairQueue != nil {
+		b.drain()
+	}
+}
+
+// gather waits for the copies of req until it has need results out of n, or too many have failed,
+// and answers the requester.
+func gather(req Request, need, n int, results chan int, errc chan error, cancel context.CancelFunc) {
+	var vals []int
+	var errs []error
+	for len(vals) < need && len(errs) <= n-need {
+		select {
+		case v := <-results:
+			vals = append(vals, v)
+		case err := <-errc:
+			errs = append(errs, err)
+		}
+	}
+	cancel() // the losers
+	if req.root != nil {
+		req.root.SetAttribute("scatter.results", len(vals))
+		req.root.End()
+	}
+	req.ack()
+	if len(vals) < need {
+		if req.Err != nil {
+			req.Err <- &GatherError{Needed: need, Copies: n, Errs: errs}
+		}
+		return
+	}
+	if s := req.Scatter; s.Results != nil {
+		s.Results <- vals
+		return
+	}
+	req.Result <- vals[0]
+}
@@ -0,0 +1,192 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scattering returns a running Balancer over n Workers and its request channel.
+func scattering(t *testing.T, n int) (*Balancer, chan Request) {
+	t.Helper()
+	b := &Balancer{Out: io.Discard}
+	wp := workers(n, 1)
+	comp := make(chan *Worker, 4*n)
+	for _, w := range wp {
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	t.Cleanup(func() { close(r) })
+	return b, r
+}
+
+func TestScatterAll(t *testing.T) {
+	b, r := scattering(t, 4)
+	release := make(chan struct{})
+	results := make(chan []int, 1)
+	r <- Request{Scatter: &Scatter{
+		Copies:  3,
+		Gather:  GatherAll,
+		Part:    func(ctx context.Context, i int) int { <-release; return i * 10 },
+		Results: results,
+	}}
+
+	// Every copy is pending on a Worker of its own.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := b.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy := 0
+	for _, w := range s.Workers {
+		switch w.Pending {
+		case 0:
+		case 1:
+			busy++
+		default:
+			t.Errorf("worker %d has %d pending, want the copies on distinct workers", w.ID, w.Pending)
+		}
+	}
+	if busy != 3 || s.Pending != 3 {
+		t.Errorf("%d busy workers and %d pending, want 3 and 3", busy, s.Pending)
+	}
+
+	close(release)
+	vals := <-results
+	sort.Ints(vals)
+	if len(vals) != 3 || vals[0] != 0 || vals[1] != 10 || vals[2] != 20 {
+		t.Errorf("results = %v, want [0 10 20]", vals)
+	}
+}
+
+func TestScatterFirst(t *testing.T) {
+	_, r := scattering(t, 3)
+	var cancelled atomic.Int64
+	var started sync.WaitGroup
+	started.Add(2)
+	res := make(chan int, 1)
+	r <- Request{Result: res, Scatter: &Scatter{
+		Copies: 3,
+		Gather: GatherFirst,
+		Part: func(ctx context.Context, i int) int {
+			if i == 0 {
+				started.Wait() // the losers are running, not skipped
+				return 42
+			}
+			started.Done()
+			<-ctx.Done() // a loser gives up once the request is complete
+			cancelled.Add(1)
+			return 0
+		},
+	}}
+	if v := <-res; v != 42 {
+		t.Errorf("result = %d, want 42", v)
+	}
+	deadline := time.Now().Add(time.Second)
+	for cancelled.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := cancelled.Load(); n != 2 {
+		t.Errorf("%d losers cancelled, want 2", n)
+	}
+}
+
+func TestScatterQuorumFails(t *testing.T) {
+	_, r := scattering(t, 3)
+	errc := make(chan error, 1)
+	// without Fn, Part or Task every copy fails
+	r <- Request{Result: make(chan int, 1), Err: errc, Scatter: &Scatter{Copies: 3, Gather: GatherQuorum, Quorum: 2}}
+	err := <-errc
+	var ge *GatherError
+	if !errors.As(err, &ge) || ge.Needed != 2 || len(ge.Errs) != 2 || !errors.Is(err, ErrNoFn) {
+		t.Errorf("err = %v, want 2 copies failed with ErrNoFn of 2 needed", err)
+	}
+
+	r <- Request{Result: make(chan int, 1), Err: errc, Scatter: &Scatter{Copies: 4}}
+	if err := <-errc; !errors.Is(err, ErrTooFewWorkers) {
+		t.Errorf("err = %v, want ErrTooFewWorkers", err)
+	}
+	for _, q := range []int{-1, 0, 4} {
+		r <- Request{Result: make(chan int, 1), Err: errc, Scatter: &Scatter{Copies: 3, Gather: GatherQuorum, Quorum: q}}
+		if err := <-errc; !errors.Is(err, ErrQuorum) {
+			t.Errorf("quorum %d: err = %v, want ErrQuorum", q, err)
+		}
+	}
+	// nowhere to send the results to
+	r <- Request{Fn: func() int { return 1 }, Err: errc, Scatter: &Scatter{Copies: 2}}
+	if err := <-errc; !errors.Is(err, ErrNoResult) {
+		t.Errorf("err = %v, want ErrNoResult", err)
+	}
+}
+
+func TestScatterZone(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	wp := workers(4, 1)
+	comp := make(chan *Worker, 8)
+	for i, w := range wp {
+		w.SetLabels(Labels{Zone: []string{"a", "b"}[i%2]})
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	defer close(r)
+
+	release := make(chan struct{})
+	res := make(chan int, 1)
+	r <- Request{Result: res, Zone: "b", Scatter: &Scatter{
+		Copies: 2,
+		Gather: GatherAll,
+		Part:   func(ctx context.Context, i int) int { <-release; return i },
+	}}
+	s, err := b.Snapshot(context.Background())
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ZoneInfo{{Zone: "b", Local: 2}}; !reflect.DeepEqual(s.Zones, want) {
+		t.Errorf("zones = %+v, want %+v", s.Zones, want)
+	}
+	<-res
+}
+
+func TestScatterFairQueue(t *testing.T) {
+	b := &Balancer{Out: io.Discard, FairQueue: NewFairQueue(nil, 8)}
+	wp := workers(2, 2)
+	wp[0].SetLabels(Labels{Zone: "x"})
+	wp[1].SetWeight(3)
+	comp := make(chan *Worker, 8)
+	for _, w := range wp {
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	defer close(r)
+
+	release := make(chan struct{})
+	defer close(release)
+	r <- Request{Fn: func() int { <-release; return 0 }, Result: make(chan int, 1), Zone: "x"}
+	// The second copy would go to the second Worker again, as it is the lighter one, but the first copy is there.
+	r <- Request{Result: make(chan int, 1), Scatter: &Scatter{
+		Copies: 2,
+		Gather: GatherAll,
+		Part:   func(ctx context.Context, i int) int { <-release; return i },
+	}}
+	s, err := b.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Workers) != 2 || s.Workers[0].Pending != 2 || s.Workers[1].Pending != 1 {
+		t.Errorf("workers = %+v, want 2 pending on the first and 1 on the second", s.Workers)
+	}
+	if len(s.Tenants) != 1 || s.Tenants[0].Dispatched != 3 {
+		t.Errorf("tenants = %+v, want the copies through the fair queue", s.Tenants)
+	}
+}
@@ -0,0 +1,158 @@
+package loadbalancer
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Selector tells which Workers can take a request: those whose capabilities have all its labels with the same values.
+type Selector map[string]string
+
+// Matches reports whether a Worker with caps can take a request with s.
+func (s Selector) Matches(caps map[string]string) bool {
+	for k, v := range s {
+		if c, ok := caps[k]; !ok || c != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the labels of s in the order of their keys, like "gpu=true,memory=large".
+func (s Selector) String() string {
+	labels := make([]string, 0, len(s))
+	for k, v := range s {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// key returns s as a string which differs for different Selectors, unlike String: every key and value is
+// prefixed by its length, so no label can pass for another.
+func (s Selector) key() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%d:%s%d:%s", len(k), k, len(s[k]), s[k])
+	}
+	return sb.String()
+}
+
+// NoMatchError is sent to Request.Err when no Worker taking requests matches its Selector.
+type NoMatchError struct {
+	Selector Selector
+}
+
+func (e *NoMatchError) Error() string {
+	return fmt.Sprintf("no worker matches selector %s", e.Selector)
+}
+
+// maxSelections is how many selections the balancer keeps, the least recently used one makes room for a new one.
+const maxSelections = 64
+
+// selection is the heap of the Workers in the pool which match a Selector. It is kept along the pool,
+// so the least loaded matching Worker is at the front like the least loaded one of the pool.
+type selection struct {
+	sel     Selector
+	workers Pool
+	index   map[*Worker]int // index of the Workers in workers, the index of Worker is the one in the pool
+	used    uint64          // when it was used last, in uses of the selections
+}
+
+func (s *selection) Len() int           { return len(s.workers) }
+func (s *selection) Less(i, j int) bool { return lighter(s.workers[i], s.workers[j]) }
+
+func (s *selection) Swap(i, j int) {
+	s.workers[i], s.workers[j] = s.workers[j], s.workers[i]
+	s.index[s.workers[i]] = i
+	s.index[s.workers[j]] = j
+}
+
+func (s *selection) Push(x any) {
+	w := x.(*Worker)
+	s.index[w] = len(s.workers)
+	s.workers = append(s.workers, w)
+}
+
+func (s *selection) Pop() any {
+	n := len(s.workers)
+	w := s.workers[n-1]
+	s.workers[n-1] = nil
+	s.workers = s.workers[:n-1]
+	delete(s.index, w)
+	return w
+}
+
+// candidates returns the Workers which can take req, in a heap: the pool or the selection of its Selector.
+// The selection is made when a Selector is seen for the first time, or again after it has been evicted.
+func (b *Balancer) candidates(req Request) Pool {
+	if len(req.Selector) == 0 {
+		return b.pool
+	}
+	key := req.Selector.key()
+	s, ok := b.selections[key]
+	if !ok {
+		if len(b.selections) >= maxSelections {
+			b.evict()
+		}
+		s = &selection{sel: req.Selector, index: make(map[*Worker]int)}
+		for _, w := range b.pool {
+			if s.sel.Matches(w.caps) {
+				heap.Push(s, w)
+			}
+		}
+		if b.selections == nil {
+			b.selections = make(map[string]*selection)
+		}
+		b.selections[key] = s
+	}
+	b.uses++
+	s.used = b.uses
+	return s.workers
+}
+
+// evict drops the least recently used selection, it is made again from the pool when it is needed.
+func (b *Balancer) evict() {
+	var lru string
+	var used uint64
+	for key, s := range b.selections {
+		if lru == "" || s.used < used {
+			lru, used = key, s.used
+		}
+	}
+	delete(b.selections, lru)
+}
+
+// joined adds w, which has joined the pool, to the selections it matches.
+func (b *Balancer) joined(w *Worker) {
+	for _, s := range b.selections {
+		if s.sel.Matches(w.caps) {
+			heap.Push(s, w)
+		}
+	}
+}
+
+// left removes w, which has left the pool, from the selections.
+func (b *Balancer) left(w *Worker) {
+	for _, s := range b.selections {
+		if i, ok := s.index[w]; ok {
+			heap.Remove(s, i)
+		}
+	}
+}
+
+// moved updates the places of w in the selections after its pending has changed.
+func (b *Balancer) moved(w *Worker) {
+	for _, s := range b.selections {
+		if i, ok := s.index[w]; ok {
+			heap.Fix(s, i)
+		}
+	}
+}
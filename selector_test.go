@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	s := Selector{"memory": "large", "gpu": "true"}
+	if got := s.String(); got != "gpu=true,memory=large" {
+		t.Errorf("String = %q", got)
+	}
+	if !s.Matches(map[string]string{"gpu": "true", "memory": "large", "os": "linux"}) {
+		t.Error("does not match a superset")
+	}
+	if s.Matches(map[string]string{"gpu": "true", "memory": "small"}) {
+		t.Error("matches a different value")
+	}
+	if !(Selector{}).Matches(nil) {
+		t.Error("an empty selector does not match")
+	}
+}
+
+func TestCapabilitiesCopied(t *testing.T) {
+	caps := map[string]string{"gpu": "true"}
+	w := NewWorker(make(chan Request))
+	w.SetCapabilities(caps)
+	caps["gpu"] = "false"
+	w.Capabilities()["gpu"] = "false"
+	if got := w.Capabilities()["gpu"]; got != "true" {
+		t.Errorf("gpu = %q, want true whatever happens to the maps given and returned", got)
+	}
+}
+
+func TestBalancerSelector(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	comp := make(chan *Worker, 16)
+	var wp Pool
+	for _, caps := range []map[string]string{nil, {"gpu": "true"}, {"gpu": "true", "memory": "large"}} {
+		w := NewWorker(make(chan Request, 8))
+		w.SetCapabilities(caps)
+		wp = append(wp, &w)
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	defer close(r)
+
+	gate := make(chan struct{})
+	res, errc := make(chan int, 16), make(chan error, 1)
+	send := func(sel Selector) {
+		r <- Request{Fn: func() int { <-gate; return 1 }, Result: res, Err: errc, Selector: sel}
+	}
+	for i := 0; i < 4; i++ {
+		send(Selector{"gpu": "true"})
+	}
+	send(Selector{"memory": "large"})
+	send(nil)
+
+	ctx := context.Background()
+	s, err := b.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the GPU requests are shared by the two GPU workers, the large memory one goes to the third worker
+	// and the last request to the idle first one
+	for i, want := range []int{1, 2, 3} {
+		if got := s.Workers[i].Pending; got != want {
+			t.Errorf("pending of worker %d = %d, want %d", i+1, got, want)
+		}
+	}
+
+	if err := b.DrainWorker(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	send(Selector{"memory": "large"})
+	var nomatch *NoMatchError
+	if err := <-errc; !errors.As(err, &nomatch) || nomatch.Selector["memory"] != "large" {
+		t.Errorf("err = %v, want no match for memory=large", err)
+	}
+	send(Selector{"gpu": "true"})
+	close(gate)
+	for i := 0; i < 7; i++ {
+		<-res
+	}
+}
+
+func TestBalancerSelections(t *testing.T) {
+	b := &Balancer{Out: io.Discard}
+	comp := make(chan *Worker, 1)
+	w := NewWorker(make(chan Request, 1))
+	w.SetCapabilities(map[string]string{"a": "b", "c": "d"})
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+
+	res, errc := make(chan int, 1), make(chan error, 1)
+	send := func(sel Selector) error {
+		r <- Request{Fn: func() int { return 1 }, Result: res, Err: errc, Selector: sel}
+		select {
+		case <-res:
+			return nil
+		case err := <-errc:
+			return err
+		}
+	}
+	if err := send(Selector{"a": "b", "c": "d"}); err != nil {
+		t.Fatal(err)
+	}
+	// Both selectors read "a=b,c=d", but this one has a single label no worker has.
+	var nomatch *NoMatchError
+	if err := send(Selector{"a": "b,c=d"}); !errors.As(err, &nomatch) {
+		t.Errorf("err = %v, want a NoMatchError", err)
+	}
+
+	for i := 0; i < 2*maxSelections; i++ {
+		send(Selector{"a": "b", "id": fmt.Sprint(i)})
+	}
+	var n int
+	b.do(context.Background(), func() error {
+		n = len(b.selections)
+		return nil
+	})
+	if n > maxSelections {
+		t.Errorf("%d selections kept, want at most %d", n, maxSelections)
+	}
+}
@@ -0,0 +1,63 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	b, r := running(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	release := make(chan struct{})
+	res := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		r <- Request{Fn: func() int { <-release; return 1 }, Result: res}
+	}
+	s, err := b.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pending != 2 || s.Dispatched != 2 || s.Completed != 0 || s.Strategy != "least-pending" {
+		t.Errorf("snapshot = %+v, want 2 pending and dispatched", s)
+	}
+	if len(s.Workers) != 1 || len(s.Workers[0].InFlight) != 2 {
+		t.Fatalf("workers = %+v, want one worker with 2 requests in flight", s.Workers)
+	}
+	if ages := s.Workers[0].InFlight; ages[0] < ages[1] {
+		t.Errorf("in-flight ages = %v, want the oldest first", ages)
+	}
+
+	close(release)
+	<-res
+	<-res
+	// the completions may arrive after the results
+	for s.Completed < 2 {
+		if s, err = b.Snapshot(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Pending != 0 || len(s.Workers[0].InFlight) != 0 {
+		t.Errorf("snapshot = %+v, want nothing pending", s)
+	}
+}
+
+func TestSnapshotStopped(t *testing.T) {
+	b := Balancer{Out: io.Discard}
+	w := NewWorker(make(chan Request))
+	r := make(chan Request)
+	done := make(chan struct{})
+	go func() {
+		b.Balance(Pool{&w}, r, make(chan *Worker))
+		close(done)
+	}()
+	close(r)
+	<-done
+	if _, err := b.Snapshot(context.Background()); !errors.Is(err, ErrStopped) {
+		t.Errorf("err = %v, want ErrStopped", err)
+	}
+}
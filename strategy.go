@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// A Strategy picks the Worker for the next request from a pool which is not empty.
+// The pool is a heap, so p[0] is the least loaded Worker. Pick is only called from the goroutine
+// running Balance, so a Strategy can keep states without locking.
+type Strategy interface {
+	Name() string
+	Pick(p Pool) *Worker
+}
+
+// LeastPending picks the Worker with the least pending requests relative to its weight.
+// This is the default strategy.
+type LeastPending struct{}
+
+func (LeastPending) Name() string { return "least-pending" }
+
+func (LeastPending) Pick(p Pool) *Worker { return p[0] }
+
+// RoundRobin picks Workers in turn, in the order of their IDs, no matter how loaded they are.
+type RoundRobin struct {
+	last int // ID of the last picked Worker
+}
+
+func (*RoundRobin) Name() string { return "round-robin" }
+
+func (r *RoundRobin) Pick(p Pool) *Worker {
+	// the Worker with the smallest ID after the last one, or the smallest ID when the last one was the largest
+	var next, first *Worker
+	for _, w := range p {
+		if first == nil || w.id < first.id {
+			first = w
+		}
+		if w.id > r.last && (next == nil || w.id < next.id) {
+			next = w
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	r.last = next.id
+	return next
+}
+
+// Random picks a Worker uniformly at random.
+type Random struct{}
+
+func (Random) Name() string { return "random" }
+
+func (Random) Pick(p Pool) *Worker { return p[rand.Intn(len(p))] }
+
+var strategies = map[string]func() Strategy{
+	LeastPending{}.Name():     func() Strategy { return LeastPending{} },
+	(*RoundRobin)(nil).Name(): func() Strategy { return new(RoundRobin) },
+	Random{}.Name():           func() Strategy { return Random{} },
+}
+
+// NewStrategy returns a new Strategy by its name, see StrategyNames.
+func NewStrategy(name string) (Strategy, error) {
+	f, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+	return f(), nil
+}
+
+// StrategyNames returns the names accepted by NewStrategy in sorted order.
+func StrategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for n := range strategies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,42 @@
+package loadbalancer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoundRobin(t *testing.T) {
+	p := Pool{{id: 3}, {id: 1}, {id: 2}}
+	var rr RoundRobin
+	var got []int
+	for i := 0; i < 5; i++ {
+		got = append(got, rr.Pick(p).id)
+	}
+	want := []int{1, 2, 3, 1, 2}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picked %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSetStrategyNil(t *testing.T) {
+	b, _ := running(t, 1)
+	ctx := context.Background()
+	if err := b.SetStrategy(ctx, &RoundRobin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetStrategy(ctx, nil); err != ErrNoStrategy {
+		t.Errorf("SetStrategy(nil) = %v, want %v", err, ErrNoStrategy)
+	}
+	if err := b.SetStrategy(ctx, (*RoundRobin)(nil)); err != ErrNoStrategy {
+		t.Errorf("SetStrategy((*RoundRobin)(nil)) = %v, want %v", err, ErrNoStrategy)
+	}
+	snap, err := b.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Strategy != "round-robin" {
+		t.Errorf("strategy = %q, want round-robin kept", snap.Strategy)
+	}
+}
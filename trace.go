@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// TraceEntry is a recorded request. A trace is a sequence of them, stored as JSON lines like
+//
+//	{"offset":"1.5s","key":"tenant-a","priority":1,"service":"20ms","result":42}
+//
+// so a production incident can be replayed through a Balancer and different set ups can be compared
+// on identical input. Durations are written in the form accepted by time.ParseDuration.
+type TraceEntry struct {
+	Offset   time.Duration // arrival time since the start of the trace
+	Key      string        // who sent the request, for example a tenant or a client
+	Priority int           // priority of the request, larger is more important, cmd/replay weighs keys by it
+	Service  time.Duration // how long the request kept a worker busy
+	Result   int           // the result the request is expected to produce
+}
+
+type traceLine struct {
+	Offset   string `json:"offset"`
+	Key      string `json:"key,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Service  string `json:"service"`
+	Result   int    `json:"result"`
+}
+
+func (e TraceEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(traceLine{
+		Offset:   e.Offset.String(),
+		Key:      e.Key,
+		Priority: e.Priority,
+		Service:  e.Service.String(),
+		Result:   e.Result,
+	})
+}
+
+func (e *TraceEntry) UnmarshalJSON(data []byte) error {
+	var l traceLine
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	offset, err := time.ParseDuration(l.Offset)
+	if err != nil {
+		return fmt.Errorf("offset: %w", err)
+	}
+	service, err := time.ParseDuration(l.Service)
+	if err != nil {
+		return fmt.Errorf("service: %w", err)
+	}
+	*e = TraceEntry{Offset: offset, Key: l.Key, Priority: l.Priority, Service: service, Result: l.Result}
+	return nil
+}
+
+// Task returns a function for Request.Fn which keeps a worker busy as long as the recorded request did
+// and returns the recorded result.
+func (e TraceEntry) Task() func() int {
+	return func() int {
+		time.Sleep(e.Service)
+		return e.Result
+	}
+}
+
+// ReadTrace reads a trace of JSON lines. Empty lines are skipped.
+// The entries are returned in the order of their offsets, entries with the same offset keep their order.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var entries []TraceEntry
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e TraceEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if e.Offset < 0 || e.Service < 0 {
+			return nil, fmt.Errorf("line %d: negative duration", n)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	return entries, nil
+}
+
+// WriteTrace writes entries as JSON lines which can be read back by ReadTrace.
+func WriteTrace(w io.Writer, entries []TraceEntry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ExampleReadTrace reads a trace which is out of order and writes it back sorted by offsets.
+func ExampleReadTrace() {
+	trace := `{"offset":"20ms","key":"b","service":"5ms","result":2}
+{"offset":"10ms","key":"a","priority":1,"service":"1.5ms","result":1}
+
+{"offset":"20ms","key":"c","service":"0s","result":3}
+`
+	entries, err := ReadTrace(strings.NewReader(trace))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	WriteTrace(os.Stdout, entries)
+
+	// Output:
+	// {"offset":"10ms","key":"a","priority":1,"service":"1.5ms","result":1}
+	// {"offset":"20ms","key":"b","service":"5ms","result":2}
+	// {"offset":"20ms","key":"c","service":"0s","result":3}
+}
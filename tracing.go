@@ -0,0 +1,194 @@
+package loadbalancer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, a tree of spans which belong to the same request.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the trace context carried by a Request, the IDs of the span new spans are children of.
+// The zero value means the request is not part of a trace yet.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether c belongs to a trace.
+func (c SpanContext) IsValid() bool { return c.TraceID != TraceID{} }
+
+// A Tracer starts spans. The Balancer starts a "dispatch" span for the decision of which Worker gets a request,
+// a "queue" span for the time the request waits in the request channel of the Worker and an "execute"
+// span for running Request.Fn. They are children of Request.Trace, or of a new "request" span when the
+// request carries no trace context. Its methods are called from many goroutines.
+type Tracer interface {
+	Start(parent SpanContext, name string) Span
+}
+
+// A Span is a timed operation of a trace.
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value any)
+	End()
+}
+
+// trace starts the spans of req before it is dispatched, they are ended by Worker.Work.
+func (b *Balancer) trace(req *Request) (dispatch Span) {
+	if b.Tracer == nil {
+		return nil
+	}
+	req.tracer = b.Tracer
+	if !req.Trace.IsValid() {
+		req.root = b.Tracer.Start(SpanContext{}, "request")
+		req.Trace = req.root.Context()
+	}
+	return b.Tracer.Start(req.Trace, "dispatch")
+}
+
+// FileTracer is a Tracer which writes each ended span to a file as a line of OTLP/JSON, the JSON
+// encoding of an OpenTelemetry ExportTraceServiceRequest. Such files can be loaded by the file receiver
+// of the OpenTelemetry Collector and from there sent to any tracing backend.
+type FileTracer struct {
+	service string
+	mu      sync.Mutex
+	enc     *json.Encoder
+}
+
+// NewFileTracer returns a FileTracer writing to w. Service is reported as the service.name of the spans.
+func NewFileTracer(w io.Writer, service string) *FileTracer {
+	return &FileTracer{service: service, enc: json.NewEncoder(w)}
+}
+
+func (t *FileTracer) Start(parent SpanContext, name string) Span {
+	s := &fileSpan{t: t, name: name, parent: parent, start: time.Now()}
+	s.ctx.TraceID = parent.TraceID
+	if !parent.IsValid() {
+		rand.Read(s.ctx.TraceID[:])
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+type fileSpan struct {
+	t      *FileTracer
+	name   string
+	ctx    SpanContext
+	parent SpanContext
+	start  time.Time
+	mu     sync.Mutex
+	attrs  []otlpKeyValue
+}
+
+func (s *fileSpan) Context() SpanContext { return s.ctx }
+
+func (s *fileSpan) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: anyValue(value)})
+}
+
+func (s *fileSpan) End() {
+	end := time.Now()
+	s.mu.Lock()
+	span := otlpSpan{
+		TraceID:           s.ctx.TraceID.String(),
+		SpanID:            s.ctx.SpanID.String(),
+		Name:              s.name,
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	s.mu.Unlock()
+	if s.parent.IsValid() {
+		span.ParentSpanID = s.parent.SpanID.String()
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: anyValue(s.t.service)}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "funmech.com/loadbalancer"},
+			Spans: []otlpSpan{span},
+		}},
+	}}}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.enc.Encode(req)
+}
+
+// The following types follow the OTLP/JSON encoding of opentelemetry-proto: IDs are hex strings and
+// 64-bit integers are decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+func anyValue(v any) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case time.Duration:
+		s := v.String()
+		return otlpAnyValue{StringValue: &s}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestFileTracer(t *testing.T) {
+	var buf bytes.Buffer
+	b := &Balancer{Out: io.Discard, Tracer: NewFileTracer(&buf, "test")}
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	defer close(r)
+
+	res := make(chan int)
+	r <- Request{Fn: func() int { return 1 }, Result: res}
+	<-res
+
+	spans := make(map[string]otlpSpan)
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var req otlpRequest
+		if err := dec.Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		spans[s.Name] = s
+	}
+	root, ok := spans["request"]
+	if !ok || len(spans) != 4 {
+		t.Fatalf("spans = %v, want request, dispatch, queue and execute", spans)
+	}
+	if root.ParentSpanID != "" {
+		t.Errorf("request span has parent %s", root.ParentSpanID)
+	}
+	for _, name := range []string{"dispatch", "queue", "execute"} {
+		s := spans[name]
+		if s.TraceID != root.TraceID || s.ParentSpanID != root.SpanID {
+			t.Errorf("%s span is not a child of the request span: %+v", name, s)
+		}
+	}
+	var workerID string
+	for _, a := range spans["dispatch"].Attributes {
+		if a.Key == "worker.id" {
+			workerID = *a.Value.IntValue
+		}
+	}
+	if workerID != "1" {
+		t.Errorf("dispatch worker.id = %q, want 1", workerID)
+	}
+}
@@ -0,0 +1,310 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells how often a WAL flushes its file to the disk with fsync.
+// A positive policy is the longest time between two flushes, see SyncEvery.
+type SyncPolicy time.Duration
+
+const (
+	// SyncAlways flushes every accepted request before it is dispatched, so none is lost in a crash
+	// of the machine. It is the slowest.
+	SyncAlways SyncPolicy = 0
+	// SyncNever leaves flushing to the operating system, accepted requests survive a crash
+	// of the process but maybe not one of the machine.
+	SyncNever SyncPolicy = -1
+)
+
+// SyncEvery returns a policy flushing at most every d, a crash of the machine loses the requests of the last d.
+func SyncEvery(d time.Duration) SyncPolicy { return SyncPolicy(d) }
+
+// compactSize is the size from which the log is rewritten with only the requests not acknowledged yet,
+// once it has at least doubled since it was last rewritten.
+const compactSize = 1 << 20
+
+// WAL is a write-ahead log of the requests a Balancer has accepted, see Balancer.Log. A request is written
+// to the log before it is dispatched and acknowledged once its result or the error of its task has been
+// delivered, so the requests which had not completed when the process died can be recovered on restart.
+// Requests are delivered at least once: one which completed just before the crash may run again.
+//
+// Only requests with a Task are logged, a Request.Fn cannot be stored. The log is a file of JSON lines.
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	policy  SyncPolicy
+	seq     uint64
+	live    map[uint64]Task // requests not acknowledged yet
+	size    int64
+	base    int64 // size right after the last rewrite
+	dirty   bool  // written since the last fsync
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	err     error // the first write error, the log is broken from then on
+
+	closing  sync.Once
+	closeErr error // what Close has returned
+}
+
+// walRecord is a line of the log.
+type walRecord struct {
+	Op   string `json:"op"` // "put" or "ack"
+	Seq  uint64 `json:"seq"`
+	Task *Task  `json:"task,omitempty"`
+}
+
+// OpenWAL opens the log at path, creating it if it does not exist. The requests of the log which have not
+// been acknowledged are kept for Recover, the rest is dropped from the file. A last line cut short by a crash is ignored.
+func OpenWAL(path string, policy SyncPolicy) (*WAL, error) {
+	live, seq, err := readWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &WAL{path: path, policy: policy, seq: seq, live: live, stop: make(chan struct{})}
+	// Rewrite the log with only the live requests, so it does not grow over restarts.
+	if err := l.rewrite(); err != nil {
+		return nil, err
+	}
+	if policy > 0 {
+		l.stopped.Add(1)
+		go l.syncer(time.Duration(policy))
+	}
+	return l, nil
+}
+
+func readWAL(path string) (map[uint64]Task, uint64, error) {
+	live := make(map[uint64]Task)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return live, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var seq uint64
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for n, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if n == len(lines)-1 && !bytes.HasSuffix(line, []byte("\n")) {
+				break // the last write was cut short
+			}
+			return nil, 0, fmt.Errorf("wal %s: line %d: %w", path, n+1, err)
+		}
+		switch rec.Op {
+		case "put":
+			if rec.Task == nil {
+				return nil, 0, fmt.Errorf("wal %s: line %d: put without a task", path, n+1)
+			}
+			live[rec.Seq] = *rec.Task
+		case "ack":
+			delete(live, rec.Seq)
+		default:
+			return nil, 0, fmt.Errorf("wal %s: line %d: unknown op %q", path, n+1, rec.Op)
+		}
+		if rec.Seq > seq {
+			seq = rec.Seq
+		}
+	}
+	return live, seq, nil
+}
+
+func (l *WAL) sorted() []uint64 {
+	seqs := make([]uint64, 0, len(l.live))
+	for s := range l.live {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// Recover returns the requests which were not acknowledged when the log was opened, in the order they
+// were accepted. They are run by r on local Workers and are acknowledged in the log when they complete,
+// like the other requests. Set their Result and Err and send them to the Balancer again.
+func (l *WAL) Recover(r *Registry) []Request {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reqs := make([]Request, 0, len(l.live))
+	for _, s := range l.sorted() {
+		req := r.Request(l.live[s])
+		req.log, req.seq = l, s
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// Len returns the count of requests which have not been acknowledged.
+func (l *WAL) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.live)
+}
+
+// Close flushes and closes the log, the log takes no more requests. Closing it again returns the same error.
+func (l *WAL) Close() error {
+	l.closing.Do(func() {
+		close(l.stop)
+		l.stopped.Wait()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		err := l.flush(true)
+		if l.f != nil { // nil when a rewrite has failed and closed it
+			if cerr := l.f.Close(); err == nil {
+				err = cerr
+			}
+			l.f = nil
+		}
+		if l.err == nil {
+			l.err = os.ErrClosed
+		}
+		l.closeErr = err
+	})
+	return l.closeErr
+}
+
+// append writes t to the log and returns its sequence number.
+func (l *WAL) append(t Task) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.write(walRecord{Op: "put", Seq: l.seq, Task: &t})
+	if err := l.flush(l.policy == SyncAlways); err != nil {
+		return 0, err
+	}
+	l.live[l.seq] = t
+	return l.seq, nil
+}
+
+// ack marks the request of seq done. Acknowledgements are not flushed on their own: losing one only runs
+// its request again.
+func (l *WAL) ack(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.live[seq]; !ok {
+		return
+	}
+	delete(l.live, seq)
+	l.write(walRecord{Op: "ack", Seq: seq})
+	if l.size >= compactSize && l.size >= 2*l.base {
+		l.rewrite()
+		return
+	}
+	l.flush(false)
+}
+
+func (l *WAL) write(rec walRecord) {
+	if l.err != nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		l.err = err
+		return
+	}
+	line = append(line, '\n')
+	if _, err := l.w.Write(line); err != nil {
+		l.err = err
+		return
+	}
+	l.size += int64(len(line))
+	l.dirty = true
+}
+
+// flush writes the buffer to the file, and to the disk when sync is true.
+func (l *WAL) flush(sync bool) error {
+	if l.err == nil {
+		l.err = l.w.Flush()
+	}
+	if l.err == nil && sync && l.dirty {
+		l.err = l.f.Sync()
+		l.dirty = false
+	}
+	return l.err
+}
+
+// rewrite replaces the log with a new file holding only the live requests, and writes to the new file
+// from then on. The new file is flushed to the disk and renamed over the old one, so a crash leaves either of them.
+func (l *WAL) rewrite() error {
+	if l.err != nil {
+		return l.err
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		l.err = err
+		return err
+	}
+	old := l.f
+	l.f, l.w, l.size, l.dirty = f, bufio.NewWriter(f), 0, false
+	for _, s := range l.sorted() {
+		t := l.live[s]
+		l.write(walRecord{Op: "put", Seq: s, Task: &t})
+	}
+	l.base = l.size
+	if l.flush(true) == nil {
+		l.err = os.Rename(tmp, l.path)
+	}
+	if l.err == nil {
+		l.err = syncDir(filepath.Dir(l.path))
+	}
+	if old != nil {
+		old.Close()
+	}
+	if l.err != nil {
+		f.Close()
+		l.f = nil
+	}
+	return l.err
+}
+
+// syncDir flushes dir to the disk, so a file renamed in it stays renamed after a crash of the machine.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncer flushes the log to the disk every d.
+func (l *WAL) syncer(d time.Duration) {
+	defer l.stopped.Done()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			l.mu.Lock()
+			l.flush(true)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// ack acknowledges req in the log it has been written to, if any.
+func (req Request) ack() {
+	if req.log != nil {
+		req.log.ack(req.seq)
+	}
+}
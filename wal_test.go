@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.wal")
+	reg := NewRegistry()
+	gate := make(chan struct{})
+	Handle(reg, "wait", JSON, func(n int) (int, error) {
+		if n > 1 {
+			<-gate
+		}
+		return n, nil
+	})
+
+	log, err := OpenWAL(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Balancer{Out: io.Discard, Log: log}
+	w := NewWorker(make(chan Request, 4))
+	comp := make(chan *Worker, 4)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+
+	res := make(chan int, 4)
+	for n := 1; n <= 3; n++ {
+		task, err := reg.Task("wait", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := reg.Request(task)
+		req.Result = res
+		r <- req
+	}
+	r <- Request{Fn: func() int { return 0 }, Result: res} // not logged
+	for log.Len() > 2 {
+		time.Sleep(time.Millisecond) // until the first request is acknowledged
+	}
+	// The process dies while the requests 2 and 3 are still running or waiting.
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err = OpenWAL(path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	reqs := log.Recover(reg)
+	if len(reqs) != 2 || string(reqs[0].Task.Payload) != "2" || string(reqs[1].Task.Payload) != "3" {
+		t.Fatalf("recovered %d requests: %+v", len(reqs), reqs)
+	}
+	close(gate)
+
+	b = &Balancer{Out: io.Discard, Log: log}
+	w2 := NewWorker(make(chan Request, 4))
+	comp = make(chan *Worker, 4)
+	go w2.Work(comp)
+	r = make(chan Request)
+	go b.Balance(Pool{&w2}, r, comp)
+	defer close(r)
+	for _, req := range reqs {
+		req.Result = make(chan int, 1)
+		r <- req
+		<-req.Result
+	}
+	if n := log.Len(); n != 0 {
+		t.Errorf("%d requests are not acknowledged", n)
+	}
+}
+
+func TestWALTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.wal")
+	data := `{"op":"put","seq":1,"task":{"name":"a"}}
+{"op":"put","seq":2,"task":{"name":"b"}}
+{"op":"ack","seq":1}
+{"op":"put","seq":3,"ta`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	log, err := OpenWAL(path, SyncEvery(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := log.Recover(NewRegistry())
+	if len(reqs) != 1 || reqs[0].Task.Name != "b" {
+		t.Errorf("recovered %+v, want task b", reqs)
+	}
+	// New requests follow the ones in the log.
+	if seq, err := log.append(Task{Name: "c"}); err != nil || seq != 3 {
+		t.Errorf("append = %d, %v, want 3", seq, err)
+	}
+	log.Close()
+
+	if err := os.WriteFile(path, []byte("{\n"+data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWAL(path, SyncNever); err == nil {
+		t.Error("a broken line in the middle is ignored")
+	}
+}
+
+func TestWALCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.wal")
+	log, err := OpenWAL(path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.append(Task{Name: "keep"}); err != nil {
+		t.Fatal(err)
+	}
+	// One request stays live while many more come and go, the log is compacted all the same.
+	payload := make([]byte, 1024)
+	for i := 0; i < 2*compactSize/len(payload); i++ {
+		seq, err := log.append(Task{Name: "go", Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.ack(seq)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= compactSize {
+		t.Errorf("log size = %d, want it compacted below %d", fi.Size(), compactSize)
+	}
+	log, err = OpenWAL(path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if reqs := log.Recover(NewRegistry()); len(reqs) != 1 || reqs[0].Task.Name != "keep" {
+		t.Errorf("recovered %+v, want task keep", reqs)
+	}
+}
+
+func TestWALCloseAfterFailedRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.wal")
+	log, err := OpenWAL(path, SyncEvery(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the log, the new file cannot be renamed over it.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "in-the-way"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	log.mu.Lock()
+	rerr := log.rewrite()
+	log.mu.Unlock()
+	if rerr == nil {
+		t.Fatal("rewrite over a directory has succeeded")
+	}
+	if err := log.Close(); err != rerr {
+		t.Errorf("Close() = %v, want the error of the rewrite %v", err, rerr)
+	}
+	if err := log.Close(); err != rerr {
+		t.Errorf("second Close() = %v, want %v again", err, rerr)
+	}
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultStallTimeout is used when Balancer.StallTimeout is not set.
+const defaultStallTimeout = 5 * time.Second
+
+// StallKind tells why the watchdog thinks the balancer has stalled.
+type StallKind int
+
+const (
+	// BlockedSend: the balancer has been waiting to send a request to a worker whose request channel is full.
+	// While it waits it receives neither requests nor completions, which is how dispatch and completion deadlock.
+	BlockedSend StallKind = iota
+	// NoProgress: requests are pending but none of them has been dispatched or completed.
+	NoProgress
+)
+
+func (k StallKind) String() string {
+	switch k {
+	case BlockedSend:
+		return "blocked on sending to a worker"
+	case NoProgress:
+		return "no progress while requests are pending"
+	}
+	return fmt.Sprintf("StallKind(%d)", int(k))
+}
+
+// ChanState is the length and capacity of a channel at the time of a Stall.
+type ChanState struct {
+	Len, Cap int
+}
+
+// WorkerState is the state of a Worker at the time of a Stall.
+type WorkerState struct {
+	ID      int       // identity of the worker, see Worker.ID
+	Index   int       // index in the heap, -1 when the worker is not in the heap
+	Pending int       // count of pending requests
+	Queue   ChanState // the request channel of the worker
+	Blocked bool      // true when the balancer is blocked on sending to this worker
+}
+
+// Stall is a diagnostic snapshot the watchdog takes when the balancer stalls.
+type Stall struct {
+	Kind       StallKind
+	Time       time.Time     // when the stall was detected
+	Duration   time.Duration // how long the balancer has been blocked or without progress
+	Pending    int           // total count of pending requests
+	Workers    []WorkerState
+	Requests   ChanState // the request channel of the balancer
+	Complete   ChanState // the completion channel of the balancer
+	Goroutines string    // dump of all goroutines, as printed by runtime/pprof
+}
+
+func (s Stall) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "balancer stalled: %v for %v, pending = %d\n", s.Kind, s.Duration, s.Pending)
+	fmt.Fprintf(&sb, "\trequests: len = %d, cap = %d\n", s.Requests.Len, s.Requests.Cap)
+	fmt.Fprintf(&sb, "\tcomplete: len = %d, cap = %d\n", s.Complete.Len, s.Complete.Cap)
+	for _, w := range s.Workers {
+		fmt.Fprintf(&sb, "\tworker %d: pending = %d, queue len = %d, cap = %d", w.ID, w.Pending, w.Queue.Len, w.Queue.Cap)
+		if w.Blocked {
+			sb.WriteString(", balancer is blocked on sending to it")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func (b *Balancer) stallTimeout() time.Duration {
+	if b.StallTimeout <= 0 {
+		return defaultStallTimeout
+	}
+	return b.StallTimeout
+}
+
+// watch checks the balancer periodically until stop is closed and calls OnStall once for each stall:
+// after a report, it waits for progress before it reports again.
+func (b *Balancer) watch(stop <-chan struct{}) {
+	timeout := b.stallTimeout()
+	period := timeout / 4
+	if period <= 0 {
+		period = 1 // NewTicker panics on a period of 0, which a timeout below 4ns gives
+	}
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	var reported time.Time // progress stamp of the last stall reported
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			s, ok := b.check(now, timeout, reported)
+			if ok {
+				reported = b.lastProgress()
+				b.OnStall(s)
+			}
+		}
+	}
+}
+
+func (b *Balancer) lastProgress() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.progress
+}
+
+// check returns a snapshot if the balancer has stalled for at least timeout and the stall has not been reported.
+func (b *Balancer) check(now time.Time, timeout time.Duration, reported time.Time) (Stall, bool) {
+	b.mu.Lock()
+	s := Stall{Time: now, Pending: b.pending}
+	switch {
+	case b.progress.Equal(reported):
+		b.mu.Unlock()
+		return s, false
+	case b.sending != nil && now.Sub(b.since) >= timeout:
+		s.Kind, s.Duration = BlockedSend, now.Sub(b.since)
+	case b.pending > 0 && now.Sub(b.progress) >= timeout:
+		s.Kind, s.Duration = NoProgress, now.Sub(b.progress)
+	default:
+		b.mu.Unlock()
+		return s, false
+	}
+	s.Requests = ChanState{len(b.req), cap(b.req)}
+	s.Complete = ChanState{len(b.complete), cap(b.complete)}
+	if w := b.sending; w != nil {
+		s.Workers = append(s.Workers, WorkerState{
+			ID:      w.id,
+			Index:   w.index,
+			Pending: w.pending,
+			Queue:   ChanState{w.queued(), w.capacity()},
+			Blocked: true,
+		})
+	}
+	for _, w := range b.pool {
+		s.Workers = append(s.Workers, WorkerState{
+			ID:      w.id,
+			Index:   w.index,
+			Pending: w.pending,
+			Queue:   ChanState{w.queued(), w.capacity()},
+		})
+	}
+	// Workers out of the heap, like draining ones, may still hold the requests which do not complete.
+	n := len(s.Workers)
+	for _, w := range b.workers {
+		if w.index < 0 && w != b.sending {
+			s.Workers = append(s.Workers, WorkerState{
+				ID:      w.id,
+				Index:   w.index,
+				Pending: w.pending,
+				Queue:   ChanState{w.queued(), w.capacity()},
+			})
+		}
+	}
+	out := s.Workers[n:]
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	b.mu.Unlock()
+
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	s.Goroutines = buf.String()
+	return s, true
+}
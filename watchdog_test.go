@@ -0,0 +1,120 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalled runs a balancer over wp with a watchdog and returns the first Stall it reports.
+func stalled(t *testing.T, wp Pool, reqs []Request) Stall {
+	t.Helper()
+	stalls := make(chan Stall, 1)
+	b := Balancer{
+		Out:          io.Discard,
+		StallTimeout: 50 * time.Millisecond,
+		OnStall: func(s Stall) {
+			select {
+			case stalls <- s:
+			default:
+			}
+		},
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, make(chan *Worker))
+	go func() {
+		for _, req := range reqs {
+			r <- req
+		}
+	}()
+	select {
+	case s := <-stalls:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stall has been reported")
+	}
+	return Stall{}
+}
+
+func TestWatchdogBlockedSend(t *testing.T) {
+	// Nobody receives from the request channel of the worker, so dispatch blocks.
+	w := NewWorker(make(chan Request))
+	s := stalled(t, Pool{&w}, []Request{{Fn: func() int { return 1 }, Result: make(chan int, 1)}})
+
+	if s.Kind != BlockedSend {
+		t.Errorf("Kind = %v, want %v", s.Kind, BlockedSend)
+	}
+	if len(s.Workers) != 1 || !s.Workers[0].Blocked || s.Workers[0].ID != w.ID() {
+		t.Errorf("Workers = %+v, want the only worker %d blocked", s.Workers, w.ID())
+	}
+	if want := fmt.Sprintf("worker %d: pending", w.ID()); !strings.Contains(s.String(), want) {
+		t.Errorf("String() = %q, want it to name the blocked worker by its ID", s.String())
+	}
+	if !strings.Contains(s.Goroutines, "goroutine") {
+		t.Error("goroutine dump is missing")
+	}
+}
+
+func TestWatchdogNoProgress(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	w := NewWorker(make(chan Request, 1))
+	go w.Work(make(chan *Worker))
+	s := stalled(t, Pool{&w}, []Request{{Fn: func() int { <-release; return 1 }, Result: make(chan int, 1)}})
+
+	if s.Kind != NoProgress {
+		t.Errorf("Kind = %v, want %v", s.Kind, NoProgress)
+	}
+	if s.Pending != 1 || len(s.Workers) != 1 || s.Workers[0].Pending != 1 {
+		t.Errorf("Pending = %d, Workers = %+v, want one pending request", s.Pending, s.Workers)
+	}
+}
+
+func TestWatchdogDraining(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	stalls := make(chan Stall, 1)
+	b := Balancer{Out: io.Discard, StallTimeout: 200 * time.Millisecond, OnStall: func(s Stall) {
+		select {
+		case stalls <- s:
+		default:
+		}
+	}}
+	w := NewWorker(make(chan Request, 1))
+	go w.Work(make(chan *Worker))
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, make(chan *Worker))
+	defer close(r)
+	r <- Request{Fn: func() int { <-release; return 1 }, Result: make(chan int, 1)}
+	// The worker leaves the heap but keeps the request which never completes.
+	if err := b.DrainWorker(context.Background(), w.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-stalls:
+		if len(s.Workers) != 1 || s.Workers[0].ID != w.ID() || s.Workers[0].Index != -1 || s.Workers[0].Pending != 1 {
+			t.Errorf("Workers = %+v, want the draining worker %d with its request", s.Workers, w.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stall has been reported")
+	}
+}
+
+func TestWatchdogTinyTimeout(t *testing.T) {
+	// A timeout below 4ns must not make the ticker panic.
+	b := Balancer{Out: io.Discard, StallTimeout: 3, OnStall: func(Stall) {}}
+	w := NewWorker(make(chan Request, 1))
+	comp := make(chan *Worker, 1)
+	go w.Work(comp)
+	r := make(chan Request)
+	go b.Balance(Pool{&w}, r, comp)
+	res := make(chan int, 1)
+	r <- Request{Fn: func() int { return 1 }, Result: res}
+	<-res
+	close(r)
+	<-b.done
+}
@@ -0,0 +1,86 @@
+package loadbalancer
+
+import "sort"
+
+// Labels tell where a Worker runs.
+type Labels struct {
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+// ZoneInfo counts the dispatched requests of a zone, of those which prefer it or run in it.
+type ZoneInfo struct {
+	Zone       string `json:"zone"`
+	Local      int    `json:"local"`       // requests for the zone sent to its Workers
+	SpilledOut int    `json:"spilled_out"` // requests for the zone sent to Workers in other zones
+	SpilledIn  int    `json:"spilled_in"`  // requests for other zones sent to the Workers of the zone
+}
+
+// pick chooses the Worker for req from its candidates p, which is not empty, or returns nil when no Worker
+// is available. It is the pick of the
+// strategy unless that is not in the zone of req or is an unhealthy group. Then it is the least loaded
+// available Worker in the zone of req, unless that has reached the SpillThreshold or there is none in the zone,
+// then it is the least loaded available Worker anywhere.
+func (b *Balancer) pick(req Request, p Pool) *Worker {
+	if w := b.strategy.Pick(p); (req.Zone == "" || w.labels.Zone == req.Zone && !b.spills(w)) && w.available() {
+		return w
+	}
+	var local, best *Worker
+	for _, w := range p {
+		if !w.available() {
+			continue
+		}
+		if req.Zone != "" && w.labels.Zone == req.Zone && (local == nil || lighter(w, local)) {
+			local = w
+		}
+		if best == nil || lighter(w, best) {
+			best = w
+		}
+	}
+	if local != nil && !b.spills(local) {
+		return local
+	}
+	return best
+}
+
+// spills reports whether w is too loaded to keep the requests of its zone local.
+func (b *Balancer) spills(w *Worker) bool {
+	return b.SpillThreshold > 0 && w.pending >= b.SpillThreshold*w.getWeight()
+}
+
+// count records where req for a zone has been sent.
+func (b *Balancer) count(req Request, w *Worker) {
+	if req.Zone == "" {
+		return
+	}
+	if req.Zone == w.labels.Zone {
+		b.zone(req.Zone).Local++
+		return
+	}
+	b.zone(req.Zone).SpilledOut++
+	if w.labels.Zone != "" {
+		b.zone(w.labels.Zone).SpilledIn++
+	}
+}
+
+func (b *Balancer) zone(name string) *ZoneInfo {
+	if b.zones == nil {
+		b.zones = make(map[string]*ZoneInfo)
+	}
+	z, ok := b.zones[name]
+	if !ok {
+		z = &ZoneInfo{Zone: name}
+		b.zones[name] = z
+	}
+	return z
+}
+
+func (b *Balancer) zoneInfos() []ZoneInfo {
+	infos := make([]ZoneInfo, 0, len(b.zones))
+	for _, z := range b.zones {
+		infos = append(infos, *z)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Zone < infos[j].Zone })
+	return infos
+}
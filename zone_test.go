@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestSpill(t *testing.T) {
+	b := &Balancer{Out: io.Discard, SpillThreshold: 2}
+	comp := make(chan *Worker, 8)
+	var wp Pool
+	for _, zone := range []string{"a", "a", "b"} {
+		w := NewWorker(make(chan Request, 4))
+		w.SetLabels(Labels{Zone: zone, Region: "eu"})
+		wp = append(wp, &w)
+		go w.Work(comp)
+	}
+	r := make(chan Request)
+	go b.Balance(wp, r, comp)
+	defer close(r)
+
+	gate := make(chan struct{})
+	res := make(chan int, 8)
+	// The Workers of a take two requests each before the next one spills to b.
+	for i := 0; i < 5; i++ {
+		r <- Request{Fn: func() int { <-gate; return 1 }, Result: res, Zone: "a"}
+	}
+	s, err := b.Snapshot(context.Background())
+	close(gate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ZoneInfo{{Zone: "a", Local: 4, SpilledOut: 1}, {Zone: "b", SpilledIn: 1}}
+	if !reflect.DeepEqual(s.Zones, want) {
+		t.Errorf("zones = %+v, want %+v", s.Zones, want)
+	}
+	if p := s.Workers[2].Pending; p != 1 {
+		t.Errorf("pending in b = %d, want 1", p)
+	}
+	for i := 0; i < 5; i++ {
+		<-res
+	}
+}